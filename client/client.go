@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"chiafactory/plotorder/plot"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
@@ -20,15 +22,127 @@ var (
 	ErrPlotHashesNotReady = errors.New("plot hashes not ready")
 )
 
+// Disposition tells apiRequest what to do once it knows the status code of a
+// response
+type Disposition int
+
+const (
+	// Success means the response should be returned to the caller as-is
+	Success Disposition = iota
+	// Retry means the request should be attempted again, following the backoff
+	// schedule (and Retry-After, for a 429)
+	Retry
+	// Fatal means the request should not be retried (eg: the credentials are wrong)
+	Fatal
+)
+
+// Classifier decides the Disposition of a request, given the HTTP status code it
+// got back
+type Classifier func(statusCode int) Disposition
+
+// defaultClassifier treats 2xx as a Success, 401/403 as Fatal (retrying won't fix
+// broken credentials), 429 and 5xx as Retry, and everything else as Fatal
+func defaultClassifier(statusCode int) Disposition {
+	switch {
+	case statusCode >= 200 && statusCode < 300:
+		return Success
+	case statusCode == http.StatusUnauthorized, statusCode == http.StatusForbidden:
+		return Fatal
+	case statusCode == http.StatusTooManyRequests, statusCode >= 500:
+		return Retry
+	default:
+		return Fatal
+	}
+}
+
+// HTTPError wraps a response that apiRequest decided not to retry (or gave up
+// retrying), so callers can inspect the status code and body that came back
+type HTTPError struct {
+	Status int
+	Body   []byte
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("unexpected status code %d", e.Status)
+}
+
+// ClientOptions configures the retry/backoff behaviour used for every request a
+// Client makes
+type ClientOptions struct {
+	// MaxElapsedTime is the maximum time we'll spend retrying a single request
+	// before giving up. Defaults to 1 minute
+	MaxElapsedTime time.Duration
+
+	// InitialInterval is how long we wait before the first retry. Defaults to
+	// backoff.DefaultInitialInterval
+	InitialInterval time.Duration
+
+	// MaxInterval caps how long we'll ever wait between retries. Defaults to
+	// backoff.DefaultMaxInterval
+	MaxInterval time.Duration
+
+	// Multiplier is applied to the retry interval after each attempt. Defaults to
+	// backoff.DefaultMultiplier
+	Multiplier float64
+
+	// Classify decides the Disposition of a response, given its status code.
+	// Defaults to defaultClassifier
+	Classify Classifier
+}
+
+func (o ClientOptions) withDefaults() ClientOptions {
+	if o.MaxElapsedTime == 0 {
+		o.MaxElapsedTime = 1 * time.Minute
+	}
+	if o.InitialInterval == 0 {
+		o.InitialInterval = backoff.DefaultInitialInterval
+	}
+	if o.MaxInterval == 0 {
+		o.MaxInterval = backoff.DefaultMaxInterval
+	}
+	if o.Multiplier == 0 {
+		o.Multiplier = backoff.DefaultMultiplier
+	}
+	if o.Classify == nil {
+		o.Classify = defaultClassifier
+	}
+	return o
+}
+
 type Client struct {
-	apiURL string
-	apiKey string
-	client *http.Client
+	apiURL  string
+	apiKey  string
+	client  *http.Client
+	options ClientOptions
+}
+
+// Order is a chiafactory.com plot order
+type Order struct {
+	ID string
+}
+
+func (o *Order) String() string {
+	return fmt.Sprintf("[order id=%s]", o.ID)
+}
+
+//GetOrder gets the order with the given ID
+func (c *Client) GetOrder(ctx context.Context, ID string) (*Order, error) {
+	response, err := c.apiRequest(ctx, http.MethodGet, fmt.Sprintf("plot_orders/%s", ID), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var r orderResponse
+	if err := json.Unmarshal(response, &r); err != nil {
+		return nil, err
+	}
+
+	return &Order{ID: r.ID}, nil
 }
 
 //GetPlot gets the plot with the given ID
 func (c *Client) GetPlot(ctx context.Context, ID string) (*plot.Plot, error) {
-	response, err := c.apiRequest(ctx, http.MethodGet, fmt.Sprintf("plots/%s", ID), nil, retryNonOk)
+	response, err := c.apiRequest(ctx, http.MethodGet, fmt.Sprintf("plots/%s", ID), nil, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -60,7 +174,7 @@ func (c *Client) DeletePlot(ctx context.Context, ID string) (*plot.Plot, error)
 		return nil, err
 	}
 
-	response, err := c.apiRequest(ctx, http.MethodPut, fmt.Sprintf("plots/%s/", ID), reqBytes, retryNonOk)
+	response, err := c.apiRequest(ctx, http.MethodPut, fmt.Sprintf("plots/%s/", ID), reqBytes, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -79,39 +193,55 @@ func (c *Client) DeletePlot(ctx context.Context, ID string) (*plot.Plot, error)
 	}, nil
 }
 
-func (c *Client) GetHashesForPlot(ctx context.Context, plotID string) ([]string, error) {
-	response, err := c.apiRequest(ctx, http.MethodGet, fmt.Sprintf("plots/%s/hashes/", plotID), nil, func(code int) bool {
-		// if the hashes are not ready, we'll get a 400, so instead of retrying here we'll
-		// let the caller handle it
-		if code == http.StatusBadRequest || code == http.StatusOK {
-			return false
+func (c *Client) GetHashesForPlot(ctx context.Context, plotID string) (plot.HashManifest, error) {
+	// if the hashes are not ready, we'll get a 400, so instead of retrying here we'll
+	// let the caller handle it
+	classify := func(statusCode int) Disposition {
+		if statusCode == http.StatusBadRequest {
+			return Success
 		}
-		return true
-	})
+		return defaultClassifier(statusCode)
+	}
+
+	response, err := c.apiRequest(ctx, http.MethodGet, fmt.Sprintf("plots/%s/hashes/", plotID), nil, classify)
 	if err != nil {
-		return nil, err
+		return plot.HashManifest{}, err
 	}
 
 	if len(response) <= 0 {
-		return nil, ErrPlotHashesNotReady
+		return plot.HashManifest{}, ErrPlotHashesNotReady
 	}
 
-	r := []string{}
-	err = json.Unmarshal(response, &r)
-	if err != nil {
-		return nil, err
+	var r hashManifestResponse
+	if err := json.Unmarshal(response, &r); err != nil {
+		// fall back to the plain array of hashes returned by API versions that
+		// don't sign their manifests yet
+		var hashes []string
+		if err := json.Unmarshal(response, &hashes); err != nil {
+			return plot.HashManifest{}, err
+		}
+		r.Hashes = hashes
 	}
 
-	if len(r) < 1 {
-		return nil, ErrPlotHashesNotReady
+	if len(r.Hashes) < 1 {
+		return plot.HashManifest{}, ErrPlotHashesNotReady
 	}
 
-	return r, nil
+	manifest := plot.HashManifest{Hashes: r.Hashes, KeyID: r.KeyID}
+	if r.Signature != "" {
+		signature, err := base64.StdEncoding.DecodeString(r.Signature)
+		if err != nil {
+			return plot.HashManifest{}, fmt.Errorf("invalid signature encoding for the verification hashes manifest: %w", err)
+		}
+		manifest.Signature = signature
+	}
+
+	return manifest, nil
 }
 
 //GetPlotsForOrderID all the plots for the order with given orderID
 func (c *Client) GetPlotsForOrderID(ctx context.Context, orderID string) ([]*plot.Plot, error) {
-	response, err := c.apiRequest(ctx, http.MethodGet, fmt.Sprintf("plot_orders/%s", orderID), nil, retryNonOk)
+	response, err := c.apiRequest(ctx, http.MethodGet, fmt.Sprintf("plot_orders/%s", orderID), nil, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -135,13 +265,31 @@ func (c *Client) GetPlotsForOrderID(ctx context.Context, orderID string) ([]*plo
 	return plots, nil
 }
 
-type retryFunction func(code int) bool
+// retryAfter parses the value of a `Retry-After` header, which can either be a
+// number of seconds or an HTTP date
+func retryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
 
-func retryNonOk(code int) bool {
-	return code != http.StatusOK
+	if when, err := http.ParseTime(header); err == nil {
+		return time.Until(when), true
+	}
+
+	return 0, false
 }
 
-func (c *Client) apiRequest(ctx context.Context, method string, endpoint string, body []byte, retryFunc retryFunction) ([]byte, error) {
+// apiRequest makes a single API call, retrying it on an exponential backoff
+// schedule (as configured by c.options) until `classify` (or c.options.Classify, if
+// `classify` is nil) says the response is a Success or Fatal, or ctx is done.
+func (c *Client) apiRequest(ctx context.Context, method string, endpoint string, body []byte, classify Classifier) ([]byte, error) {
+	if classify == nil {
+		classify = c.options.Classify
+	}
 
 	var requestBody io.Reader
 	if body != nil {
@@ -149,62 +297,81 @@ func (c *Client) apiRequest(ctx context.Context, method string, endpoint string,
 	}
 
 	url := fmt.Sprintf("%s/%s", c.apiURL, endpoint)
-	log.Debugf("%s making %s request to %s", c, method, url)
 
-	req, err := http.NewRequestWithContext(
-		ctx,
-		method,
-		url,
-		requestBody,
+	exp := backoff.NewExponentialBackOff()
+	exp.InitialInterval = c.options.InitialInterval
+	exp.MaxInterval = c.options.MaxInterval
+	exp.Multiplier = c.options.Multiplier
+	exp.MaxElapsedTime = c.options.MaxElapsedTime
+
+	var (
+		lastErr      error
+		responseBody []byte
 	)
 
-	header := req.Header
-	header.Set("Accept", "application/json")
-	header.Set("Content-Type", "application/json")
-	header.Set("Authorization", fmt.Sprintf("Token %s", c.apiKey))
-
-	if err != nil {
-		return nil, err
-	}
+	operation := func() error {
+		req, err := http.NewRequestWithContext(ctx, method, url, requestBody)
+		if err != nil {
+			return backoff.Permanent(err)
+		}
 
-	// We'll retry API requests using an exponential back-off schedule
-	exp := backoff.NewExponentialBackOff()
-	exp.MaxElapsedTime = 1 * time.Minute
+		header := req.Header
+		header.Set("Accept", "application/json")
+		header.Set("Content-Type", "application/json")
+		header.Set("Authorization", fmt.Sprintf("Token %s", c.apiKey))
 
-	ticker := backoff.NewTicker(exp)
-	defer ticker.Stop()
+		log.Debugf("%s making %s request to %s", c, method, url)
 
-	var responseBody []byte
-	for range ticker.C {
-		var res *http.Response
-		res, err = c.client.Do(req)
+		res, err := c.client.Do(req)
 		if err != nil {
-			log.Errorf("%s error while making %s request to %s: %s", c, method, url, err.Error())
-			continue
+			lastErr = err
+			return err
 		}
 
-		responseBody, err = func() ([]byte, error) {
+		body, err := func() ([]byte, error) {
 			defer res.Body.Close()
 			return io.ReadAll(res.Body)
 		}()
 		if err != nil {
-			log.Errorf("%s error while reading the response body after %s request to %s: %s", c, method, url, err.Error())
-			continue
+			lastErr = err
+			return err
 		}
 
-		// Check if we need to retry this API call, based on the provided retryFunc
-		retry := retryFunc(res.StatusCode)
-
-		log.Debugf("%s got status code %d for (%s %s, retry=%t)", c, res.StatusCode, method, url, retry)
-
-		// If we don't need to retry, stop the ticker and bail
-		if !retry {
-			ticker.Stop()
-			break
+		disposition := classify(res.StatusCode)
+		log.Debugf("%s got status code %d for (%s %s, disposition=%d)", c, res.StatusCode, method, url, disposition)
+
+		switch disposition {
+		case Success:
+			responseBody = body
+			lastErr = nil
+			return nil
+		case Fatal:
+			lastErr = &HTTPError{Status: res.StatusCode, Body: body}
+			return backoff.Permanent(lastErr)
+		default: // Retry
+			lastErr = &HTTPError{Status: res.StatusCode, Body: body}
+
+			if res.StatusCode == http.StatusTooManyRequests {
+				if wait, ok := retryAfter(res.Header.Get("Retry-After")); ok {
+					timer := time.NewTimer(wait)
+					select {
+					case <-timer.C:
+					case <-ctx.Done():
+						timer.Stop()
+						lastErr = ctx.Err()
+						return backoff.Permanent(lastErr)
+					}
+				}
+			}
+
+			return lastErr
 		}
 	}
 
-	if err != nil {
+	if err := backoff.Retry(operation, backoff.WithContext(exp, ctx)); err != nil {
+		if lastErr != nil {
+			return nil, lastErr
+		}
 		return nil, err
 	}
 
@@ -215,10 +382,16 @@ func (c *Client) String() string {
 	return "[client]"
 }
 
-func NewClient(apiKey, apiURL string) *Client {
+func NewClient(apiKey, apiURL string, opts ...ClientOptions) *Client {
+	var options ClientOptions
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+
 	return &Client{
-		apiKey: apiKey,
-		apiURL: apiURL,
-		client: http.DefaultClient,
+		apiKey:  apiKey,
+		apiURL:  apiURL,
+		client:  http.DefaultClient,
+		options: options.withDefaults(),
 	}
 }
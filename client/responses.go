@@ -20,3 +20,17 @@ type plotResponse struct {
 type getPlotsForOrderIDResponse struct {
 	Plots []*plotResponse
 }
+
+type updatePlotRequest struct {
+	ID            string `json:"id"`
+	State         string `json:"state"`
+	DownloadState int    `json:"download_state"`
+}
+
+// hashManifestResponse is the signed manifest of verification hashes for a plot.
+// Signature and KeyID are omitted by API versions that don't sign their manifests
+type hashManifestResponse struct {
+	Hashes    []string `json:"hashes"`
+	KeyID     string   `json:"key_id"`
+	Signature string   `json:"signature"` // base64-encoded
+}
@@ -3,14 +3,20 @@ package cmd
 import (
 	"bufio"
 	"chiafactory/plotorder/client"
+	"chiafactory/plotorder/coordinator"
+	"chiafactory/plotorder/plot"
 	"chiafactory/plotorder/processor"
+	"chiafactory/plotorder/state"
 	"context"
+	"crypto/ed25519"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/signal"
 	"path"
+	"strings"
 	"syscall"
 	"time"
 
@@ -30,6 +36,12 @@ var (
 	plotDirs           []string
 	logsDir            string
 	plotCheckFrequency time.Duration
+	maxDownloads       int
+	coordinatorURL     string
+	stateFile          string
+	resetState         bool
+	progressStreamFile string
+	pinnedKeys         []string
 	verbose            bool
 	rootCmd            = &cobra.Command{
 		Use:   "plotorder",
@@ -41,6 +53,17 @@ var (
 			}
 
 			reporter := processor.NewReporter()
+			if progressStreamFile != "" {
+				f, err := os.OpenFile(progressStreamFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+				if err != nil {
+					log.Errorf("could not open --progress-stream file (%s): %s", progressStreamFile, err)
+					return
+				}
+				defer f.Close()
+				reporter = processor.NewMultiReporter(reporter, processor.NewJSONReporter(f))
+				log.Infof("writing a machine-readable progress stream to %s", progressStreamFile)
+			}
+
 			reporter.Start()
 			defer reporter.Stop()
 
@@ -78,6 +101,23 @@ var (
 				return
 			}
 
+			for _, pinnedKey := range pinnedKeys {
+				keyID, encodedKey, ok := strings.Cut(pinnedKey, ":")
+				if !ok {
+					log.Errorf("--pinned-key (%s) is not in '<keyID>:<base64 public key>' format", pinnedKey)
+					return
+				}
+
+				publicKey, err := base64.StdEncoding.DecodeString(encodedKey)
+				if err != nil {
+					log.Errorf("--pinned-key (%s) does not contain a valid base64 public key: %s", pinnedKey, err)
+					return
+				}
+
+				plot.RegisterPinnedKey(keyID, ed25519.PublicKey(publicKey))
+				log.Infof("pinned additional hash manifest signing key %s", keyID)
+			}
+
 			if len(plotDirs) == 0 {
 				cwd, err := os.Getwd()
 				if err != nil {
@@ -116,6 +156,18 @@ var (
 				}
 			}
 
+			if stateFile == "" {
+				stateFile = path.Join(logsDir, "plotorder.state.db")
+			}
+			stateStore := state.NewStore(stateFile)
+			if resetState {
+				if err := stateStore.Reset(); err != nil {
+					log.Errorf("could not reset the state file (%s): %s", stateFile, err)
+					return
+				}
+				log.Infof("state file (%s) has been reset", stateFile)
+			}
+
 			// we're using the reporter and a log file writer. The reporter will
 			// write to stdout until the first render
 			log.SetOutput(
@@ -133,11 +185,23 @@ var (
 			log.Infof("apiKey=%s, apiURL=%s, plotDirs=%s, logsDir=%s", fmt.Sprintf("****%s", apiKey[len(apiKey)-4:]), apiURL, plotDirs, logsDir)
 
 			client := client.NewClient(apiKey, apiURL)
-			proc, err := processor.NewProcessor(client, reporter, plotDirs, plotCheckFrequency)
+			proc, err := processor.NewProcessor(client, reporter, plotDirs, plotCheckFrequency, maxDownloads)
 			if err != nil {
 				log.Error("plot processing could not start")
 				return
 			}
+			proc.SetStateStore(stateStore)
+
+			if coordinatorURL != "" {
+				coord, err := coordinator.NewNATSCoordinator(coordinatorURL, proc.Status)
+				if err != nil {
+					log.Errorf("could not connect to the coordinator at %s: %s", coordinatorURL, err)
+					return
+				}
+				defer coord.Close()
+				proc.SetCoordinator(coord)
+				log.Infof("coordinating with other instances through %s", coordinatorURL)
+			}
 
 			log.Infof("Loading plots, please wait")
 			err = proc.Start(ctx, orderID)
@@ -172,6 +236,12 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&orderID, "order-id", "", "the id of the order you want to process plots for")
 	rootCmd.PersistentFlags().StringArrayVar(&plotDirs, "plot-dir", []string{}, "the paths where to store downloaded plots")
 	rootCmd.PersistentFlags().DurationVar(&plotCheckFrequency, "plot-check-frequency", 5*time.Second, "the time between checks on an order's plots")
+	rootCmd.PersistentFlags().IntVar(&maxDownloads, "max-downloads", 0, "the maximum number of plots to download at the same time (0 means unlimited)")
+	rootCmd.PersistentFlags().StringVar(&coordinatorURL, "coordinator", "", "a NATS server URL (eg: nats://localhost:4222) used to cooperate with other plotorder instances draining the same order")
+	rootCmd.PersistentFlags().StringVar(&stateFile, "state-file", "", "where to persist the processor's schedule and retry counters, so it can resume without reprobing every plot (defaults to plotorder.state.db under --logs-dir)")
+	rootCmd.PersistentFlags().BoolVar(&resetState, "reset-state", false, "discard the state file before starting, forcing every plot to be reprobed from scratch")
+	rootCmd.PersistentFlags().StringVar(&progressStreamFile, "progress-stream", "", "write one NDJSON progress event per tick to this file, alongside the normal output")
+	rootCmd.PersistentFlags().StringArrayVar(&pinnedKeys, "pinned-key", []string{}, "a '<keyID>:<base64 Ed25519 public key>' pair to trust when verifying signed hash manifests (can be repeated for a key rotation). There is no default pinned key: if chiafactory.com starts signing manifests and none is provided, verification fails and the affected plots won't download")
 	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "config file to use")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "enables verbose logging (DEBUG level)")
 	rootCmd.PersistentFlags().StringVar(&logsDir, "logs-dir", "", "the paths where to store downloaded plots")
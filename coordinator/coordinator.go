@@ -0,0 +1,44 @@
+// Package coordinator lets several plotorder instances cooperatively drain one
+// order's plots between them, without duplicating downloads.
+package coordinator
+
+import "context"
+
+// ClaimResult is returned by Coordinator.Claim, telling the caller whether it won
+// the right to download a plot
+type ClaimResult struct {
+	Won bool
+}
+
+// Coordinator decides, for an instance that's about to start downloading a plot,
+// whether it should go ahead or leave it to another instance
+type Coordinator interface {
+	// Claim asks whether this instance should download plotID, given freeSpace
+	// (this instance's free bytes, keyed by plotDir). It may block for a short
+	// negotiation window before returning
+	Claim(ctx context.Context, plotID string, freeSpace map[string]int64) (ClaimResult, error)
+
+	// Release gives up a previously-won claim, eg: because the download failed and
+	// another instance should be given the chance to pick it up
+	Release(plotID string)
+
+	// Heartbeat announces that this instance, and the claims it's won, are still
+	// alive. Call it periodically; other instances release a claim once it stops
+	// being heartbeated
+	Heartbeat(ctx context.Context)
+
+	// Close disconnects the coordinator
+	Close()
+}
+
+// NoopCoordinator is the default Coordinator: every instance wins every claim, so
+// single-instance behaviour is unchanged
+type NoopCoordinator struct{}
+
+func (NoopCoordinator) Claim(ctx context.Context, plotID string, freeSpace map[string]int64) (ClaimResult, error) {
+	return ClaimResult{Won: true}, nil
+}
+
+func (NoopCoordinator) Release(plotID string)         {}
+func (NoopCoordinator) Heartbeat(ctx context.Context) {}
+func (NoopCoordinator) Close()                        {}
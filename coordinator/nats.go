@@ -0,0 +1,258 @@
+package coordinator
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	claimSubjectPrefix = "plotorder.claim."
+	heartbeatSubject   = "plotorder.heartbeat"
+	negotiationWindow  = 200 * time.Millisecond
+	heartbeatInterval  = 10 * time.Second
+	staleClaimTTL      = 30 * time.Second
+)
+
+// claimRequest is broadcast on plotorder.claim.<plotID> by an instance that wants
+// to download a plot. Every other instance that's willing to compete for it
+// replies on the request's reply subject with a claimOffer
+type claimRequest struct {
+	InstanceID string `json:"instance_id"`
+}
+
+// claimOffer tells the requester how much free space a competing instance has, and
+// how busy it currently is. Busier instances delay their reply proportionally to
+// their active transfer count, the same trick chia-garden's distribution model
+// uses to let the least busy instance win without a central arbiter
+type claimOffer struct {
+	InstanceID      string           `json:"instance_id"`
+	FreeSpace       map[string]int64 `json:"free_space"`
+	ActiveTransfers int              `json:"active_transfers"`
+}
+
+// heartbeatMsg is broadcast periodically by every instance, listing the plots it's
+// currently claimed, so the others know to leave them alone
+type heartbeatMsg struct {
+	InstanceID string   `json:"instance_id"`
+	PlotIDs    []string `json:"plot_ids"`
+}
+
+type claimRecord struct {
+	instanceID string
+	lastSeen   time.Time
+}
+
+// Status reports this instance's free space per plotDir and how many transfers it
+// currently has in flight, so claim negotiation can take load into account
+type Status func() (freeSpace map[string]int64, activeTransfers int)
+
+// NATSCoordinator is a Coordinator backed by a NATS connection
+type NATSCoordinator struct {
+	conn       *nats.Conn
+	sub        *nats.Subscription
+	heartbeats *nats.Subscription
+	instanceID string
+	status     Status
+
+	mu     sync.Mutex
+	won    map[string]bool
+	claims map[string]claimRecord
+}
+
+// NewNATSCoordinator connects to the NATS server at url and starts replying to
+// claim requests from other instances. status is consulted on every incoming
+// request to report this instance's free space and load
+func NewNATSCoordinator(url string, status Status) (*NATSCoordinator, error) {
+	conn, err := nats.Connect(url)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &NATSCoordinator{
+		conn:       conn,
+		instanceID: nats.NewInbox(),
+		status:     status,
+		won:        map[string]bool{},
+		claims:     map[string]claimRecord{},
+	}
+
+	c.sub, err = conn.Subscribe(claimSubjectPrefix+"*", c.handleClaimRequest)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c.heartbeats, err = conn.Subscribe(heartbeatSubject, c.handleHeartbeat)
+	if err != nil {
+		c.sub.Unsubscribe()
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *NATSCoordinator) handleClaimRequest(msg *nats.Msg) {
+	freeSpace, activeTransfers := c.status()
+
+	offer := claimOffer{
+		InstanceID:      c.instanceID,
+		FreeSpace:       freeSpace,
+		ActiveTransfers: activeTransfers,
+	}
+	body, err := json.Marshal(offer)
+	if err != nil {
+		log.Warnf("[coordinator] could not build a claim offer: %s", err)
+		return
+	}
+
+	// delay our reply proportionally to how busy we are, so an idle instance tends
+	// to win the negotiation without needing a central arbiter
+	delay := time.Duration(activeTransfers) * 20 * time.Millisecond
+	time.AfterFunc(delay, func() {
+		if err := c.conn.Publish(msg.Reply, body); err != nil {
+			log.Warnf("[coordinator] failed to reply to a claim request: %s", err)
+		}
+	})
+}
+
+func (c *NATSCoordinator) handleHeartbeat(msg *nats.Msg) {
+	var hb heartbeatMsg
+	if err := json.Unmarshal(msg.Data, &hb); err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for _, plotID := range hb.PlotIDs {
+		c.claims[plotID] = claimRecord{instanceID: hb.InstanceID, lastSeen: now}
+	}
+}
+
+// claimedByOther returns whether plotID has a live (non-stale) claim from an
+// instance other than this one
+func (c *NATSCoordinator) claimedByOther(plotID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	claim, ok := c.claims[plotID]
+	if !ok {
+		return false
+	}
+	if claim.instanceID == c.instanceID {
+		return false
+	}
+	return time.Since(claim.lastSeen) < staleClaimTTL
+}
+
+func freeSpaceTotal(freeSpace map[string]int64) int64 {
+	var total int64
+	for _, bytes := range freeSpace {
+		total += bytes
+	}
+	return total
+}
+
+// Claim asks the rest of the cluster whether this instance should download
+// plotID. If another instance is already heartbeating a claim for it, this
+// instance gives up immediately; otherwise, it broadcasts a claim request and
+// waits for the negotiation window to pick the instance with the most free space
+func (c *NATSCoordinator) Claim(ctx context.Context, plotID string, freeSpace map[string]int64) (ClaimResult, error) {
+	if c.claimedByOther(plotID) {
+		return ClaimResult{Won: false}, nil
+	}
+
+	inbox := nats.NewInbox()
+	sub, err := c.conn.SubscribeSync(inbox)
+	if err != nil {
+		return ClaimResult{}, err
+	}
+	defer sub.Unsubscribe()
+
+	req, err := json.Marshal(claimRequest{InstanceID: c.instanceID})
+	if err != nil {
+		return ClaimResult{}, err
+	}
+
+	if err := c.conn.PublishRequest(claimSubjectPrefix+plotID, inbox, req); err != nil {
+		return ClaimResult{}, err
+	}
+
+	bestInstanceID := c.instanceID
+	bestFreeSpace := freeSpaceTotal(freeSpace)
+
+	deadline := time.Now().Add(negotiationWindow)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+
+		msg, err := sub.NextMsg(remaining)
+		if err != nil {
+			break // negotiation window elapsed (or the connection is gone)
+		}
+
+		var offer claimOffer
+		if err := json.Unmarshal(msg.Data, &offer); err != nil {
+			continue
+		}
+
+		offerFreeSpace := freeSpaceTotal(offer.FreeSpace)
+		if offerFreeSpace > bestFreeSpace || (offerFreeSpace == bestFreeSpace && offer.InstanceID < bestInstanceID) {
+			bestInstanceID = offer.InstanceID
+			bestFreeSpace = offerFreeSpace
+		}
+	}
+
+	won := bestInstanceID == c.instanceID
+	c.mu.Lock()
+	c.won[plotID] = won
+	c.mu.Unlock()
+
+	return ClaimResult{Won: won}, nil
+}
+
+// Release gives up a claim this instance previously won
+func (c *NATSCoordinator) Release(plotID string) {
+	c.mu.Lock()
+	delete(c.won, plotID)
+	c.mu.Unlock()
+}
+
+// Heartbeat broadcasts the plots this instance currently holds a claim for. It's
+// meant to be called on a timer (every heartbeatInterval or so); instances that
+// stop heartbeating have their claims treated as stale after staleClaimTTL
+func (c *NATSCoordinator) Heartbeat(ctx context.Context) {
+	c.mu.Lock()
+	plotIDs := make([]string, 0, len(c.won))
+	for plotID, won := range c.won {
+		if won {
+			plotIDs = append(plotIDs, plotID)
+		}
+	}
+	c.mu.Unlock()
+
+	body, err := json.Marshal(heartbeatMsg{InstanceID: c.instanceID, PlotIDs: plotIDs})
+	if err != nil {
+		log.Warnf("[coordinator] could not build a heartbeat: %s", err)
+		return
+	}
+
+	if err := c.conn.Publish(heartbeatSubject, body); err != nil {
+		log.Warnf("[coordinator] failed to publish a heartbeat: %s", err)
+	}
+}
+
+// Close disconnects from NATS
+func (c *NATSCoordinator) Close() {
+	c.sub.Unsubscribe()
+	c.heartbeats.Unsubscribe()
+	c.conn.Close()
+}
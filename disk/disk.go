@@ -0,0 +1,138 @@
+// Package disk reports free space on plot download directories and tracks, in
+// memory, how much of that space this process has already earmarked for plots
+// that are about to start downloading.
+//
+// The OS-specific files in this package (disk_unix.go, disk_openbsd.go,
+// disk_windows.go) each implement stat, which is all Manager needs to support a
+// new platform.
+package disk
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrNotEnoughSpace reports that a plot needs more bytes than a directory's
+// current free-for-new space. Reserve does not check free space, so it never
+// returns this error
+var ErrNotEnoughSpace = errors.New("not enough space to reserve")
+
+// ReservationID identifies a reservation made by Reserve, so it can later be
+// given back to Release
+type ReservationID uint64
+
+// Space describes the capacity of the volume backing a plot download directory.
+// Total and Used come straight from the OS; ReservedByUs and FreeForNew account
+// for bytes this process has already committed to plots that haven't written
+// them to disk yet
+type Space struct {
+	Total        uint64
+	Used         uint64
+	ReservedByUs uint64
+	FreeForNew   uint64
+}
+
+type reservation struct {
+	deviceID string
+	bytes    uint64
+}
+
+// statFn is the platform stat() implementation Manager uses. It's a variable
+// rather than a direct call so tests can point Manager at a fake filesystem
+// (see SetStatFuncForTest) instead of real disks
+var statFn = stat
+
+// SetStatFuncForTest overrides the stat implementation used by every Manager,
+// returning a function that restores the previous one. It exists so tests can
+// exercise directory-selection logic (resume-first, spillover) against a fake
+// filesystem without touching real disks
+func SetStatFuncForTest(f func(directory string) (total uint64, available uint64, deviceID string, err error)) (restore func()) {
+	prev := statFn
+	statFn = f
+	return func() { statFn = prev }
+}
+
+// Manager tracks, per underlying device, how many bytes this process has
+// reserved for plots that are about to download but haven't finished writing
+// yet. Without it, two goroutines calling GetAvailableSpace for the same
+// directory at the same time can both see the same free space and both pick it,
+// overcommitting the disk. A Manager is safe for concurrent use
+type Manager struct {
+	mu           sync.Mutex
+	nextID       ReservationID
+	reservations map[ReservationID]reservation
+}
+
+// NewManager creates an empty Manager
+func NewManager() *Manager {
+	return &Manager{reservations: map[ReservationID]reservation{}}
+}
+
+// GetAvailableSpace reports the space on the volume backing directory,
+// including how much of it this Manager has already reserved
+func (m *Manager) GetAvailableSpace(directory string) (Space, error) {
+	total, available, deviceID, err := statFn(directory)
+	if err != nil {
+		return Space{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var reserved uint64
+	for _, r := range m.reservations {
+		if r.deviceID == deviceID {
+			reserved += r.bytes
+		}
+	}
+
+	var freeForNew uint64
+	if available > reserved {
+		freeForNew = available - reserved
+	}
+
+	return Space{
+		Total:        total,
+		Used:         total - available,
+		ReservedByUs: reserved,
+		FreeForNew:   freeForNew,
+	}, nil
+}
+
+// Reserve earmarks bytes on the volume backing directory, so a later call to
+// GetAvailableSpace (from this or another goroutine) won't offer the same bytes
+// to a second plot. The caller is expected to have already checked FreeForNew is
+// large enough; Reserve itself only fails if directory can't be stat'd
+func (m *Manager) Reserve(directory string, bytes int64) (ReservationID, error) {
+	_, _, deviceID, err := statFn(directory)
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextID++
+	id := m.nextID
+	m.reservations[id] = reservation{deviceID: deviceID, bytes: uint64(bytes)}
+	return id, nil
+}
+
+// Release gives up a reservation previously returned by Reserve. Releasing an
+// unknown or already-released id is a no-op, the same way coordinator.Release
+// tolerates giving up a claim that was never held
+func (m *Manager) Release(id ReservationID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.reservations, id)
+}
+
+// Bytes reports how many bytes id has reserved, or 0 if id is unknown. It's
+// meant for callers (eg: the Processor's state snapshot) that want to record
+// what's currently reserved without holding a reference to the reservation
+// itself
+func (m *Manager) Bytes(id ReservationID) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return int64(m.reservations[id].bytes)
+}
@@ -0,0 +1,25 @@
+package disk
+
+import (
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// stat returns the total and available bytes on the volume backing directory,
+// plus a deviceID that's stable for every directory on that volume
+func stat(directory string) (uint64, uint64, string, error) {
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(directory, &statfs); err != nil {
+		return 0, 0, "", err
+	}
+
+	var st unix.Stat_t
+	if err := unix.Stat(directory, &st); err != nil {
+		return 0, 0, "", err
+	}
+
+	total := uint64(statfs.F_blocks) * uint64(statfs.F_bsize)
+	available := uint64(statfs.F_bavail) * uint64(statfs.F_bsize)
+	return total, available, strconv.Itoa(int(st.Dev)), nil
+}
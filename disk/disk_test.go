@@ -0,0 +1,91 @@
+package disk_test
+
+import (
+	"chiafactory/plotorder/disk"
+	"testing"
+)
+
+// fakeFilesystem lets tests stand in for real disks: each directory maps to a
+// total/available byte count and a device ID, the same three values the
+// platform-specific stat() would return
+type fakeFilesystem map[string]struct {
+	total, available uint64
+	deviceID          string
+}
+
+func (fs fakeFilesystem) stat(directory string) (uint64, uint64, string, error) {
+	d := fs[directory]
+	return d.total, d.available, d.deviceID, nil
+}
+
+func TestManagerGetAvailableSpaceAccountsForReservations(t *testing.T) {
+	fs := fakeFilesystem{
+		"/plots/a": {total: 1000, available: 600, deviceID: "dev0"},
+	}
+	restore := disk.SetStatFuncForTest(fs.stat)
+	defer restore()
+
+	m := disk.NewManager()
+
+	space, err := m.GetAvailableSpace("/plots/a")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if space.FreeForNew != 600 {
+		t.Fatalf("expected FreeForNew=600 before any reservation, got %d", space.FreeForNew)
+	}
+
+	id, err := m.Reserve("/plots/a", 400)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	space, err = m.GetAvailableSpace("/plots/a")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if space.FreeForNew != 200 {
+		t.Fatalf("expected FreeForNew=200 after reserving 400 of 600, got %d", space.FreeForNew)
+	}
+	if space.ReservedByUs != 400 {
+		t.Fatalf("expected ReservedByUs=400, got %d", space.ReservedByUs)
+	}
+
+	m.Release(id)
+
+	space, err = m.GetAvailableSpace("/plots/a")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if space.FreeForNew != 600 {
+		t.Fatalf("expected FreeForNew=600 after releasing the reservation, got %d", space.FreeForNew)
+	}
+}
+
+func TestManagerReservationsAreScopedByDevice(t *testing.T) {
+	fs := fakeFilesystem{
+		"/plots/a": {total: 1000, available: 500, deviceID: "dev0"},
+		"/plots/b": {total: 1000, available: 500, deviceID: "dev1"},
+	}
+	restore := disk.SetStatFuncForTest(fs.stat)
+	defer restore()
+
+	m := disk.NewManager()
+
+	if _, err := m.Reserve("/plots/a", 500); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	space, err := m.GetAvailableSpace("/plots/b")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if space.FreeForNew != 500 {
+		t.Fatalf("a reservation on a different device should not affect /plots/b, got FreeForNew=%d", space.FreeForNew)
+	}
+}
+
+func TestManagerReleaseIsNoopForUnknownID(t *testing.T) {
+	m := disk.NewManager()
+	m.Release(disk.ReservationID(999))
+}
@@ -1,4 +1,4 @@
-// +build linux darwin
+// +build linux darwin freebsd
 
 package disk
 
@@ -8,15 +8,20 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func GetAvailableSpace(directory string) (uint64, string, error) {
+// stat returns the total and available bytes on the volume backing directory,
+// plus a deviceID that's stable for every directory on that volume
+func stat(directory string) (uint64, uint64, string, error) {
 	var statfs unix.Statfs_t
 	if err := unix.Statfs(directory, &statfs); err != nil {
-		return 0, "", err
+		return 0, 0, "", err
 	}
 
-	var stat unix.Stat_t
-	if err := unix.Stat(directory, &stat); err != nil {
-		return 0, "", err
+	var st unix.Stat_t
+	if err := unix.Stat(directory, &st); err != nil {
+		return 0, 0, "", err
 	}
-	return statfs.Bavail * uint64(statfs.Bsize), strconv.Itoa(int(stat.Dev)), nil
+
+	total := uint64(statfs.Blocks) * uint64(statfs.Bsize)
+	available := uint64(statfs.Bavail) * uint64(statfs.Bsize)
+	return total, available, strconv.Itoa(int(st.Dev)), nil
 }
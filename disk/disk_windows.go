@@ -1,13 +1,40 @@
 package disk
 
 import (
+	"fmt"
 	"path/filepath"
 	"unsafe"
 
 	"golang.org/x/sys/windows"
 )
 
-func GetAvailableSpace(directory string) (uint64, string, error) {
+// getVolumeSerialNumber returns the serial number of the volume that `directory`
+// lives on. We use this (rather than the volume name) as the "device id" so we can
+// detect when two plot directories resolve to the same underlying volume
+func getVolumeSerialNumber(directory string) (string, error) {
+	h := windows.MustLoadDLL("kernel32.dll")
+	c := h.MustFindProc("GetVolumeInformationW")
+
+	root := filepath.VolumeName(directory) + `\`
+
+	var serialNumber uint32
+	ret, _, err := c.Call(
+		uintptr(unsafe.Pointer(windows.StringToUTF16Ptr(root))),
+		0, 0, // volume name buffer (unused)
+		uintptr(unsafe.Pointer(&serialNumber)),
+		0, 0, // maximum component length, filesystem flags (unused)
+		0, 0, // filesystem name buffer (unused)
+	)
+	if ret == 0 {
+		return "", err
+	}
+
+	return fmt.Sprintf("%d", serialNumber), nil
+}
+
+// stat returns the total and available bytes on the volume backing directory,
+// plus a deviceID that's stable for every directory on that volume
+func stat(directory string) (uint64, uint64, string, error) {
 	h := windows.MustLoadDLL("kernel32.dll")
 	c := h.MustFindProc("GetDiskFreeSpaceExW")
 
@@ -17,8 +44,14 @@ func GetAvailableSpace(directory string) (uint64, string, error) {
 		uintptr(unsafe.Pointer(&freeBytes)),
 		uintptr(unsafe.Pointer(&totalBytes)),
 		uintptr(unsafe.Pointer(&availableBytes)))
-	if err.(windows.Errno) == 0 {
-		return uint64(freeBytes), filepath.VolumeName(directory), nil
+	if err.(windows.Errno) != 0 {
+		return 0, 0, "", err
 	}
-	return 0, "", err
+
+	deviceID, err := getVolumeSerialNumber(directory)
+	if err != nil {
+		return 0, 0, "", err
+	}
+
+	return uint64(totalBytes), uint64(freeBytes), deviceID, nil
 }
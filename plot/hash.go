@@ -2,6 +2,7 @@ package plot
 
 import (
 	"fmt"
+	"hash"
 	"io"
 
 	"golang.org/x/crypto/blake2b"
@@ -34,3 +35,47 @@ func calculateChunkHash(chunk io.Reader) (string, error) {
 	}
 	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
+
+// chunkHasher incrementally hashes a hashChunkSize-aligned chunk as its bytes are
+// written to disk, so we don't have to read the chunk back later to validate it
+type chunkHasher struct {
+	// index is the 0-indexed chunk number this hasher is verifying
+	index int64
+
+	// size is the total number of bytes this chunk is expected to have
+	size int64
+
+	// written is how many of those bytes have been fed into h so far
+	written int64
+
+	h hash.Hash
+}
+
+// newChunkHasher creates a chunkHasher for chunk `index`, which is `size` bytes
+// long. `alreadyWritten` lets the caller seed the hasher's byte count when some of
+// the chunk's bytes were hashed separately (eg: read back from disk) before the
+// hasher was created
+func newChunkHasher(index, size, alreadyWritten int64) (*chunkHasher, error) {
+	h, err := blake2b.New512(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkHasher{index: index, size: size, written: alreadyWritten, h: h}, nil
+}
+
+// write feeds `p` into the hasher, as if it had just been written to disk
+func (c *chunkHasher) write(p []byte) {
+	c.h.Write(p)
+	c.written += int64(len(p))
+}
+
+// done tells us whether every byte of this chunk has been fed into the hasher
+func (c *chunkHasher) done() bool {
+	return c.written >= c.size
+}
+
+// sum returns the hash calculated so far, formatted the same way as
+// calculateChunkHash
+func (c *chunkHasher) sum() string {
+	return fmt.Sprintf("%x", c.h.Sum(nil))
+}
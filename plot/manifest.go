@@ -0,0 +1,63 @@
+package plot
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+)
+
+// HashManifest is the set of per-chunk verification hashes for a plot. When
+// Signature is present, it's an Ed25519 signature (made with the key identified by
+// KeyID) over the ordered concatenation of the plot ID, the download size, the hash
+// chunk size and the hashes themselves
+type HashManifest struct {
+	Hashes    []string
+	KeyID     string
+	Signature []byte
+}
+
+// pinnedKeys maps a signing key ID to the Ed25519 public key used to verify signed
+// hash manifests. There is no default: nobody outside chiafactory.com can attest
+// to what its signing key actually is, so operators who want signed-manifest
+// verification must pin a key themselves with `--pinned-key` (see cmd/root.go)
+// before chiafactory.com turns signing on. Without a pinned key, a signed
+// manifest simply fails verification and the plot's download is refused, the
+// same as any other unrecognised key ID
+var pinnedKeys = map[string]ed25519.PublicKey{}
+
+// RegisterPinnedKey pins the Ed25519 public key used to verify hash manifests
+// signed with `keyID`
+func RegisterPinnedKey(keyID string, publicKey ed25519.PublicKey) {
+	pinnedKeys[keyID] = publicKey
+}
+
+// manifestMessage builds the exact byte sequence a hash manifest's signature
+// covers, so a compromised or MITM'd API can't feed us attacker-chosen chunk
+// hashes that happen to validate attacker-supplied bytes
+func manifestMessage(plotID string, downloadSize int64, hashes []string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(plotID)
+	binary.Write(&buf, binary.BigEndian, downloadSize)
+	binary.Write(&buf, binary.BigEndian, hashChunkSize)
+	for _, h := range hashes {
+		buf.WriteString(h)
+	}
+	return buf.Bytes()
+}
+
+// verifyManifest checks a HashManifest's signature against the pinned public key
+// for its KeyID
+func verifyManifest(plotID string, downloadSize int64, manifest HashManifest) error {
+	publicKey, ok := pinnedKeys[manifest.KeyID]
+	if !ok {
+		return fmt.Errorf("verification hashes are signed with an unknown key (%s)", manifest.KeyID)
+	}
+
+	msg := manifestMessage(plotID, downloadSize, manifest.Hashes)
+	if !ed25519.Verify(publicKey, msg, manifest.Signature) {
+		return fmt.Errorf("signature for the verification hashes is invalid")
+	}
+
+	return nil
+}
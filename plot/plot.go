@@ -1,7 +1,6 @@
 package plot
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"io"
@@ -11,8 +10,10 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/cenkalti/backoff/v4"
 	"github.com/dustin/go-humanize"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
@@ -33,23 +34,47 @@ type DownloadState string
 
 const (
 	// Plot download statuses (only used in this tool)
-	DownloadStateLookingForDownloadDirectory DownloadState = "LOOKING_FOR_DOWNLOAD_DIRECTORY"
-	DownloadStateNotStarted                  DownloadState = "NOT_STARTED"
-	DownloadStateWaitingForHashes            DownloadState = "WAITING_FOR_HASHES"
-	DownloadStatePreparing                   DownloadState = "PREPARING"
-	DownloadStateReady                       DownloadState = "READY"
-	DownloadStateDownloading                 DownloadState = "DOWNLOADING"
-	DownloadStateDownloaded                  DownloadState = "DOWNLOADED"
-	DownloadStateFailed                      DownloadState = "FAILED"
-	DownloadStateInitialValidation           DownloadState = "INITIAL_VALIDATION"
-	DownloadStateLiveValidation              DownloadState = "LIVE_VALIDATION"
-	DownloadStateFailedValidation            DownloadState = "FAILED_VALIDATION"
-	DownloadStateEnqueued                    DownloadState = "ENQUEUED"
+	DownloadStateLookingForDownloadLocation DownloadState = "LOOKING_FOR_DOWNLOAD_DIRECTORY"
+	DownloadStateNotStarted                 DownloadState = "NOT_STARTED"
+	DownloadStateWaitingForHashes           DownloadState = "WAITING_FOR_HASHES"
+	DownloadStatePreparing                  DownloadState = "PREPARING"
+	DownloadStateReady                      DownloadState = "READY"
+	// DownloadStateResuming is entered instead of DownloadStateDownloading when
+	// Download finds bytes already on disk from a previous run, before it starts
+	// fetching the ranges that are still missing
+	DownloadStateResuming          DownloadState = "RESUMING"
+	DownloadStateDownloading       DownloadState = "DOWNLOADING"
+	DownloadStateDownloaded        DownloadState = "DOWNLOADED"
+	DownloadStateFailed            DownloadState = "FAILED"
+	DownloadStateInitialValidation DownloadState = "INITIAL_VALIDATION"
+	DownloadStateLiveValidation    DownloadState = "LIVE_VALIDATION"
+	DownloadStateFailedValidation  DownloadState = "FAILED_VALIDATION"
+	DownloadStateEnqueued          DownloadState = "ENQUEUED"
 )
 
 // hashChunkSize is the maximum size (in bytes) of the chunks we'll validate
 const hashChunkSize = int64(10 * 1000 * 1000 * 1000)
 
+// defaultMinChunkSize is the default size (in bytes) of the sub-chunks we download in
+// parallel, each with its own Range request
+const defaultMinChunkSize = int64(32 * 1024 * 1024)
+
+// defaultMaxConcurrency is the default number of sub-chunk downloads we'll have in
+// flight at the same time for a single plot
+const defaultMaxConcurrency = 4
+
+// byteRange represents a half-open interval ([start, stop)) of the plot file we'll
+// fetch with a single `Range` request
+type byteRange struct {
+	start int64
+	stop  int64
+}
+
+// errValidationFailed is returned by downloadRangesConcurrently when a chunk fails
+// verification. It's used so Download() doesn't overwrite the DownloadStateFailedValidation
+// state it sets with the more generic DownloadStateFailed
+var errValidationFailed = errors.New("chunk validation failed")
+
 type downloadHistoryRecord struct {
 	bytes int64
 	time  time.Time
@@ -88,6 +113,27 @@ type Plot struct {
 
 	// when validation fails, this will be set to the position from which we have to restart downloading
 	truncateFrom *int64
+
+	// minChunkSize is the size (in bytes) of each sub-chunk requested in parallel. A
+	// sub-chunk is never bigger than this and never straddles a hashChunkSize boundary.
+	// When zero, defaultMinChunkSize is used
+	minChunkSize int64
+
+	// maxConcurrency is how many sub-chunk downloads are allowed in flight at once for
+	// this plot. When zero, defaultMaxConcurrency is used
+	maxConcurrency int
+}
+
+// SetMinChunkSize overrides the size (in bytes) of the sub-chunks requested in parallel
+// while downloading this plot. It must be called before Download
+func (p *Plot) SetMinChunkSize(bytes int64) {
+	p.minChunkSize = bytes
+}
+
+// SetDownloadConcurrency overrides the number of sub-chunk Range requests issued in
+// parallel while downloading this plot. It must be called before Download
+func (p *Plot) SetDownloadConcurrency(n int) {
+	p.maxConcurrency = n
 }
 
 func (p *Plot) recordDownloadedBytes() {
@@ -147,16 +193,30 @@ func (p *Plot) UpdatePlottingProgress(progress int) {
 	p.PlottingProgress = progress
 }
 
-func (p *Plot) GetDownloadSpeed() string {
+// DownloadBytesPerSecond returns the current download rate for this plot, computed
+// from the same samples used by GetDownloadSpeed. The second return is false when
+// there isn't enough history yet or the rate can't be trusted (eg: right after a
+// failed chunk validation truncates the file)
+func (p *Plot) DownloadBytesPerSecond() (float64, bool) {
 	if len(p.downloadHistory) < 2 {
-		return "Starting"
+		return 0, false
 	}
 	first := p.downloadHistory[0]
 	last := p.downloadHistory[len(p.downloadHistory)-1]
 	bytesPerSecond := float64(last.bytes-first.bytes) / float64(last.time.Unix()-first.time.Unix())
-
-	// this will happen after a failed chunk validation
 	if bytesPerSecond < 0 {
+		return 0, false
+	}
+	return bytesPerSecond, true
+}
+
+func (p *Plot) GetDownloadSpeed() string {
+	if len(p.downloadHistory) < 2 {
+		return "Starting"
+	}
+
+	bytesPerSecond, ok := p.DownloadBytesPerSecond()
+	if !ok {
 		return "-"
 	}
 
@@ -241,6 +301,81 @@ func (p *Plot) validateChunk(number int64) (valid bool, err error) {
 	return valid, nil
 }
 
+// chunkSize returns the size (in bytes) of the hashChunkSize-aligned chunk with the
+// given 0-indexed number
+func (p *Plot) chunkSize(number int64) int64 {
+	stop := (number + 1) * hashChunkSize
+	if stop > p.downloadSize {
+		stop = p.downloadSize
+	}
+	return stop - number*hashChunkSize
+}
+
+// newChunkHasherAt creates a chunkHasher for the hash chunk that byte offset `from`
+// falls into. If part of that chunk was already written to disk in a previous run
+// (so its in-memory hasher state is gone by now), those bytes are read back once to
+// seed the hasher; everything after that is hashed as it streams in, so we don't
+// have to read it back again later
+func (p *Plot) newChunkHasherAt(from int64) (*chunkHasher, error) {
+	index := from / hashChunkSize
+	chunkStart := index * hashChunkSize
+	alreadyWritten := from - chunkStart
+
+	hasher, err := newChunkHasher(index, p.chunkSize(index), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if alreadyWritten > 0 {
+		handle, err := os.Open(p.f.Name())
+		if err != nil {
+			return nil, err
+		}
+		defer handle.Close()
+
+		if _, err := handle.Seek(chunkStart, io.SeekStart); err != nil {
+			return nil, err
+		}
+
+		if _, err := io.CopyN(hasher.h, handle, alreadyWritten); err != nil {
+			return nil, err
+		}
+		hasher.written = alreadyWritten
+	}
+
+	return hasher, nil
+}
+
+// verifyChunk compares a completed chunkHasher's sum against the hash we got from
+// the API for that chunk. On a mismatch it behaves like validateChunk: it records
+// where the download has to resume from
+func (p *Plot) verifyChunk(hasher *chunkHasher) (valid bool, err error) {
+	if int(hasher.index) >= len(p.fileChunkHashes) {
+		return false, fmt.Errorf("chunk to verify (%d; 0-indexed) is greater than the available number of hashes (%d)", hasher.index, len(p.fileChunkHashes))
+	}
+
+	expectedChunkHash := p.fileChunkHashes[hasher.index]
+	chunkHash := hasher.sum()
+	if chunkHash == expectedChunkHash {
+		log.Infof("%s chunk %d is valid (calculated=%s, expected=%s)", p, hasher.index, chunkHash, expectedChunkHash)
+		return true, nil
+	}
+
+	chunkStart := hasher.index * hashChunkSize
+	log.Errorf("%s chunk %d is invalid (calculated=%s, expected=%s). We'll resume downloading from %d", p, hasher.index, chunkHash, expectedChunkHash, chunkStart)
+	p.truncateFrom = &chunkStart
+	return false, nil
+}
+
+// ExpectedFilename returns the local filename this plot will be downloaded to,
+// derived from DownloadURL. Unlike GetDownloadFilename, it's available before
+// InitialiseDownload runs, so callers that need to look for an existing partial
+// download (eg: the state cache) don't have to wait for the download state
+// machine to get there
+func (p *Plot) ExpectedFilename() (string, error) {
+	return p.getDownloadFilename()
+}
+
 func (p *Plot) getDownloadFilename() (filepath string, err error) {
 	parsed, err := url.Parse(p.DownloadURL)
 	if err != nil {
@@ -270,50 +405,6 @@ func (p *Plot) getDownloadSize() (fileSize int64, err error) {
 	return strconv.ParseInt(contentLength, 10, 0)
 }
 
-func (p *Plot) startValidator(ctx context.Context) {
-	go func() {
-		ticker := time.NewTicker(1 * time.Second)
-		prevChunkN := p.getDownloadedBytes() / hashChunkSize
-		defer ticker.Stop()
-
-		for range ticker.C {
-			downloaded := p.getDownloadedBytes()
-			currChunkN := downloaded / hashChunkSize
-			if currChunkN != prevChunkN || downloaded == p.downloadSize {
-				prevState := p.downloadState
-				p.updateDownloadState(DownloadStateLiveValidation)
-
-				// handle last chunk
-				chunk := prevChunkN
-				if downloaded == p.downloadSize {
-					chunk = currChunkN
-				}
-
-				var valid bool
-				valid, err := p.validateChunk(chunk)
-				if err != nil {
-					log.Errorf("%s error while validating chunk (%d): %s", p, chunk, err.Error())
-					p.updateDownloadState(DownloadStateFailedValidation)
-					return
-				}
-
-				if !valid {
-					p.updateDownloadState(DownloadStateFailedValidation)
-					return
-				}
-				prevChunkN = currChunkN
-				p.updateDownloadState(prevState)
-			}
-
-			select {
-			case <-ctx.Done():
-				return
-			default:
-			}
-		}
-	}()
-}
-
 func (p *Plot) startRecorder(ctx context.Context) {
 	go func() {
 		ticker := time.NewTicker(1 * time.Second)
@@ -335,6 +426,11 @@ func (p *Plot) GetRemainingBytes() int64 {
 	return p.downloadSize - p.getDownloadedBytes()
 }
 
+// GetDownloadedBytes returns how many bytes of this plot have been downloaded so far
+func (p *Plot) GetDownloadedBytes() int64 {
+	return p.getDownloadedBytes()
+}
+
 func (p *Plot) SetDownloadError() {
 	p.downloadError = true
 }
@@ -355,7 +451,7 @@ func (p *Plot) InitialiseDownload() error {
 		return err
 	}
 	p.downloadFilename = fileName
-	p.updateDownloadState(DownloadStateLookingForDownloadDirectory)
+	p.updateDownloadState(DownloadStateLookingForDownloadLocation)
 	return nil
 }
 
@@ -363,26 +459,42 @@ func (p *Plot) requiredNumberOfFileHashes() int {
 	return int(math.Ceil(float64(p.downloadSize) / float64(hashChunkSize)))
 }
 
-func (p *Plot) SetFileHashes(hashes []string) {
+// SetFileHashes stores the verification hashes for this plot. When `manifest` is
+// signed (its Signature is set), the signature is checked against the pinned public
+// key for its KeyID before the hashes are accepted; Download refuses to start if
+// that check fails, since accepting unverified hashes would let a compromised or
+// MITM'd API feed us attacker-chosen chunk hashes
+func (p *Plot) SetFileHashes(manifest HashManifest) error {
 	required := p.requiredNumberOfFileHashes()
-	if len(hashes) < required {
-		log.Warnf("%s does not yet have all required plot file verification hashes (has=%d, requires=%s)", p, len(hashes), required)
-		return
+	if len(manifest.Hashes) < required {
+		log.Warnf("%s does not yet have all required plot file verification hashes (has=%d, requires=%d)", p, len(manifest.Hashes), required)
+		return nil
+	}
+
+	if manifest.Signature != nil {
+		if err := verifyManifest(p.ID, p.downloadSize, manifest); err != nil {
+			return err
+		}
+		log.Infof("%s verification hashes are signed and verified (key=%s)", p, manifest.KeyID)
 	}
-	p.fileChunkHashes = hashes
-	log.Debugf("%s using %d plot file verification hashes", p, len(hashes))
+
+	p.fileChunkHashes = manifest.Hashes
+	log.Debugf("%s using %d plot file verification hashes", p, len(manifest.Hashes))
 	p.updateDownloadState(DownloadStateNotStarted)
+	return nil
 }
 
 func (p *Plot) SetDownloadDirectory(dir string) (err error) {
 	filePath := path.Join(dir, p.downloadFilename)
 
-	// we'll create a new file if it does not exist or append to
-	// it if it does
+	// we'll create a new file if it does not exist or reopen it for
+	// random-access writes if it does, since downloadRangesConcurrently
+	// writes each sub-chunk at its own offset via WriteAt, which os.File rejects
+	// on a file opened with O_APPEND
 	var openFlags int
 	_, err = os.Stat(filePath)
 	if err == nil {
-		openFlags = os.O_RDWR | os.O_APPEND
+		openFlags = os.O_RDWR
 	} else {
 		openFlags = os.O_CREATE | os.O_EXCL | os.O_RDWR
 	}
@@ -477,18 +589,6 @@ func (p *Plot) PrepareDownload(ctx context.Context) (err error) {
 	return
 }
 
-func (p *Plot) RetryDownload(ctx context.Context) (err error) {
-	// if there's an active download, cancel it
-	if p.cancelDownload != nil {
-		log.Infof("%s cancelling current download", p)
-		p.cancelDownload()
-	}
-
-	log.Infof("%s retrying download", p)
-	p.updateDownloadState(DownloadStateReady)
-	return nil
-}
-
 func (p *Plot) Download(ctx context.Context) (err error) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer func() {
@@ -499,7 +599,11 @@ func (p *Plot) Download(ctx context.Context) (err error) {
 	p.cancelDownload = cancel
 
 	defer func() {
-		if err != nil {
+		if err == errValidationFailed {
+			// the DownloadStateFailedValidation state was already set by
+			// downloadRangesConcurrently
+			return
+		} else if err != nil {
 			log.Errorf("%s download failed: %s", p, err.Error())
 			p.updateDownloadState(DownloadStateFailed)
 		} else if p.getDownloadedBytes() == p.downloadSize {
@@ -537,84 +641,218 @@ func (p *Plot) Download(ctx context.Context) (err error) {
 		p.truncateFrom = nil
 	}
 
-	p.updateDownloadState(DownloadStateDownloading)
-
-	var req *http.Request
-	req, err = http.NewRequest(http.MethodGet, p.DownloadURL, nil)
-	if err != nil {
-		return
+	downloadedBytes := p.getDownloadedBytes()
+	ranges := p.downloadRanges(downloadedBytes)
+	if len(ranges) == 0 {
+		return nil
 	}
 
-	var (
-		expectedStatusCode = http.StatusOK
-		downloadedBytes    = p.getDownloadedBytes()
-	)
 	if downloadedBytes > 0 {
-		expectedStatusCode = http.StatusPartialContent
+		// stays DownloadStateResuming until downloadRangesConcurrently has
+		// actually written a sub-chunk to disk, so a processor tick landing in
+		// this window reports resuming rather than downloading
+		p.updateDownloadState(DownloadStateResuming)
 		log.Infof("%s resuming download (%s already downloaded) from %s into %s", p, humanize.Bytes(uint64(downloadedBytes)), p.DownloadURL, p.f.Name())
-		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", downloadedBytes))
 	} else {
+		p.updateDownloadState(DownloadStateDownloading)
 		log.Infof("%s starting download from %s into %s", p, p.DownloadURL, p.f.Name())
 	}
 
-	var resp *http.Response
-	resp, err = http.DefaultClient.Do(req)
-	if err != nil {
-		err = errors.Wrap(err, "error while making the HTTP request to download the file")
-		return
+	p.startRecorder(ctx)
+
+	err = p.downloadRangesConcurrently(ctx, ranges)
+	return err
+}
+
+// downloadRanges splits [from, p.downloadSize) into sub-chunks of at most
+// p.minChunkSize bytes each, making sure none of them straddles a hashChunkSize
+// boundary so each chunk can be verified as soon as it's been fully written to disk
+func (p *Plot) downloadRanges(from int64) []byteRange {
+	minChunkSize := p.minChunkSize
+	if minChunkSize <= 0 {
+		minChunkSize = defaultMinChunkSize
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != expectedStatusCode {
-		err = fmt.Errorf("invalid status code returned (%d)", resp.StatusCode)
-		return
+
+	var ranges []byteRange
+	for start := from; start < p.downloadSize; {
+		chunkBoundary := (start/hashChunkSize + 1) * hashChunkSize
+
+		stop := start + minChunkSize
+		if stop > chunkBoundary {
+			stop = chunkBoundary
+		}
+		if stop > p.downloadSize {
+			stop = p.downloadSize
+		}
+
+		ranges = append(ranges, byteRange{start: start, stop: stop})
+		start = stop
 	}
+	return ranges
+}
 
-	var chunkSize = int64(8192)
+// downloadRange fetches a single byteRange with its own `Range` request, retrying
+// with an exponential backoff if it fails. Retrying here means a flaky connection
+// doesn't have to restart the whole file, just the sub-chunk that failed
+func (p *Plot) downloadRange(ctx context.Context, r byteRange) ([]byte, error) {
+	buf := make([]byte, r.stop-r.start)
 
-	// when this channel gets written into, we'll finish the download process
-	done := make(chan error)
-	p.startValidator(ctx)
-	p.startRecorder(ctx)
-	go func() {
+	operation := func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.DownloadURL, nil)
+		if err != nil {
+			return backoff.Permanent(err)
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.start, r.stop-1))
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusPartialContent {
+			return fmt.Errorf("invalid status code returned (%d) while downloading bytes %d-%d", resp.StatusCode, r.start, r.stop-1)
+		}
 
-		var (
-			chunk    = make([]byte, chunkSize)
-			filebuff = bufio.NewWriterSize(p.f, int(chunkSize))
-			err      error
-		)
+		_, err = io.ReadFull(resp.Body, buf)
+		return err
+	}
 
-		defer func() {
-			filebuff.Flush()
-			done <- err
+	exp := backoff.NewExponentialBackOff()
+	exp.MaxElapsedTime = 2 * time.Minute
+
+	if err := backoff.Retry(operation, backoff.WithContext(exp, ctx)); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// downloadRangesConcurrently fetches `ranges` using up to p.maxConcurrency range
+// requests at a time, writing each sub-chunk into p.f at its correct offset with
+// WriteAt. Completed sub-chunks are flushed to disk in order, so the file always
+// grows contiguously. As each chunk boundary is crossed, the bytes that were just
+// written are fed through a blake2b hasher (rather than read back from disk) and
+// compared against the hash we got from the API for that chunk
+func (p *Plot) downloadRangesConcurrently(ctx context.Context, ranges []byteRange) error {
+	maxConcurrency := p.maxConcurrency
+	if maxConcurrency <= 0 {
+		maxConcurrency = defaultMaxConcurrency
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type rangeResult struct {
+		r   byteRange
+		buf []byte
+		err error
+	}
+
+	jobs := make(chan byteRange)
+	results := make(chan rangeResult)
+
+	var workers sync.WaitGroup
+	for i := 0; i < maxConcurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for r := range jobs {
+				buf, err := p.downloadRange(ctx, r)
+				select {
+				case results <- rangeResult{r: r, buf: buf, err: err}:
+				case <-ctx.Done():
+					return
+				}
+			}
 		}()
+	}
 
-		for {
-			// if the context has been cancelled, bail here
+	go func() {
+		defer close(jobs)
+		for _, r := range ranges {
 			select {
+			case jobs <- r:
 			case <-ctx.Done():
 				return
-			default:
 			}
+		}
+	}()
+
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	nextOffset := ranges[0].start
+	hasher, err := p.newChunkHasherAt(nextOffset)
+	if err != nil {
+		cancel()
+	}
+
+	pending := map[int64][]byte{}
+	for res := range results {
+		if err != nil {
+			continue
+		}
+
+		if res.err != nil {
+			err = errors.Wrapf(res.err, "error while downloading bytes %d-%d", res.r.start, res.r.stop-1)
+			cancel()
+			continue
+		}
+
+		pending[res.r.start] = res.buf
 
-			// otherwise, read a new chunk and write it to our file
-			r, readErr := resp.Body.Read(chunk)
-			if r > 0 {
-				filebuff.Write(chunk[0:r])
+		// flush every sub-chunk that's now at the front of the file, in order
+		for {
+			buf, ok := pending[nextOffset]
+			if !ok {
+				break
 			}
 
-			if readErr == io.EOF {
+			if _, writeErr := p.f.WriteAt(buf, nextOffset); writeErr != nil {
+				err = writeErr
+				cancel()
 				break
 			}
+			delete(pending, nextOffset)
 
-			if readErr != nil {
-				err = readErr
-				log.Errorf("there was an error reading the plot file from the server (%s)", err.Error())
-				return
+			if p.downloadState == DownloadStateResuming {
+				p.updateDownloadState(DownloadStateDownloading)
+			}
+
+			hasher.write(buf)
+			nextOffset += int64(len(buf))
+
+			if hasher.done() {
+				prevState := p.downloadState
+				p.updateDownloadState(DownloadStateLiveValidation)
+
+				var valid bool
+				valid, err = p.verifyChunk(hasher)
+				if err != nil {
+					cancel()
+					break
+				}
+				if !valid {
+					p.updateDownloadState(DownloadStateFailedValidation)
+					err = errValidationFailed
+					cancel()
+					break
+				}
+				p.updateDownloadState(prevState)
+
+				if nextOffset < p.downloadSize {
+					hasher, err = p.newChunkHasherAt(nextOffset)
+					if err != nil {
+						cancel()
+						break
+					}
+				}
 			}
 		}
-	}()
+	}
 
-	err = <-done
 	return err
 }
 
@@ -0,0 +1,132 @@
+package processor
+
+import (
+	"chiafactory/plotorder/disk"
+	"chiafactory/plotorder/plot"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+// newTestPlot returns a Plot whose downloadSize/downloadFilename have been
+// populated the same way InitialiseDownload does, but against a local
+// httptest server instead of a real download URL
+func newTestPlot(t *testing.T, id, filename string, size int64) *plot.Plot {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	p := &plot.Plot{ID: id, DownloadURL: server.URL + "/" + filename}
+	if err := p.InitialiseDownload(); err != nil {
+		t.Fatalf("InitialiseDownload: %s", err)
+	}
+	return p
+}
+
+// fakeDisks stands in for real disks: each directory maps to the total and
+// available byte counts a real stat() would return
+type fakeDisks map[string]struct{ total, available uint64 }
+
+func (fs fakeDisks) stat(directory string) (uint64, uint64, string, error) {
+	d := fs[directory]
+	return d.total, d.available, directory, nil
+}
+
+func newTestProcessor(plotDirs []string) *Processor {
+	return &Processor{
+		plotDirs:     plotDirs,
+		diskMgr:      disk.NewManager(),
+		reservations: map[string]disk.ReservationID{},
+	}
+}
+
+func TestGetPlotDownloadDirectoryResumesAPartialDownload(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	p := newTestPlot(t, "plot-a", "plot-a.plot", 1000)
+
+	// dirB already has a partial download of the plot
+	if err := os.WriteFile(path.Join(dirB, p.GetDownloadFilename()), make([]byte, 400), 0644); err != nil {
+		t.Fatalf("could not write partial file: %s", err)
+	}
+
+	restore := disk.SetStatFuncForTest(fakeDisks{
+		dirA: {total: 10000, available: 10000},
+		dirB: {total: 10000, available: 10000},
+	}.stat)
+	defer restore()
+
+	proc := newTestProcessor([]string{dirA, dirB})
+
+	got, err := proc.getPlotDownloadDirectory(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != dirB {
+		t.Fatalf("expected to resume the existing download in %s, got %s", dirB, got)
+	}
+}
+
+func TestGetPlotDownloadDirectoryFailsWhenNotEnoughSpaceToResume(t *testing.T) {
+	dirA := t.TempDir()
+	p := newTestPlot(t, "plot-a", "plot-a.plot", 1000)
+
+	if err := os.WriteFile(path.Join(dirA, p.GetDownloadFilename()), make([]byte, 400), 0644); err != nil {
+		t.Fatalf("could not write partial file: %s", err)
+	}
+
+	restore := disk.SetStatFuncForTest(fakeDisks{
+		// 1000-400=600 bytes left to download, but only 100 are free
+		dirA: {total: 10000, available: 100},
+	}.stat)
+	defer restore()
+
+	proc := newTestProcessor([]string{dirA})
+
+	if _, err := proc.getPlotDownloadDirectory(p); err != ErrNotEnoughSpace {
+		t.Fatalf("expected ErrNotEnoughSpace, got %v", err)
+	}
+}
+
+func TestGetPlotDownloadDirectorySpillsOverToTheNextDirectoryWithSpace(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	p := newTestPlot(t, "plot-a", "plot-a.plot", 1000)
+
+	restore := disk.SetStatFuncForTest(fakeDisks{
+		dirA: {total: 10000, available: 500},  // not enough for a fresh 1000 byte plot
+		dirB: {total: 10000, available: 2000}, // enough
+	}.stat)
+	defer restore()
+
+	proc := newTestProcessor([]string{dirA, dirB})
+
+	got, err := proc.getPlotDownloadDirectory(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != dirB {
+		t.Fatalf("expected to spill over to %s, got %s", dirB, got)
+	}
+}
+
+func TestGetPlotDownloadDirectoryFailsWhenNoDirectoryHasSpace(t *testing.T) {
+	dirA := t.TempDir()
+	p := newTestPlot(t, "plot-a", "plot-a.plot", 1000)
+
+	restore := disk.SetStatFuncForTest(fakeDisks{
+		dirA: {total: 10000, available: 1},
+	}.stat)
+	defer restore()
+
+	proc := newTestProcessor([]string{dirA})
+
+	if _, err := proc.getPlotDownloadDirectory(p); err != ErrNotEnoughSpace {
+		t.Fatalf("expected ErrNotEnoughSpace, got %v", err)
+	}
+}
@@ -2,8 +2,11 @@ package processor
 
 import (
 	"chiafactory/plotorder/client"
+	"chiafactory/plotorder/coordinator"
 	"chiafactory/plotorder/disk"
 	"chiafactory/plotorder/plot"
+	"chiafactory/plotorder/processor/xfer"
+	"chiafactory/plotorder/state"
 	"context"
 	"errors"
 	"fmt"
@@ -17,6 +20,14 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// heartbeatFrequency is how often the Processor announces to the coordinator
+// (when one is configured) which plots it currently holds a claim for
+const heartbeatFrequency = 10 * time.Second
+
+// stateSaveFrequency is how often the Processor's schedule and retry counters
+// are saved to its state file (when one is configured)
+const stateSaveFrequency = 30 * time.Second
+
 var (
 	ErrNotEnoughSpace = errors.New("not enough space to download")
 	ErrFinished       = errors.New("finished")
@@ -29,13 +40,17 @@ type Processor struct {
 	client *client.Client
 
 	// reporter will paint the current status of the Processor to stdout
-	reporter *Reporter
+	reporter Reporter
 
 	// plots is the list of plots the processor is working with
 	plots []*plot.Plot
 
-	// downloads is used to keep track of the plots being downloaded
-	downloads sync.WaitGroup
+	// transfers schedules and retries the downloads for plots that are ready
+	transfers *xfer.Manager
+
+	// coordinator lets this Processor cooperate with other plotorder instances
+	// when claiming plots to download. Defaults to coordinator.NoopCoordinator
+	coordinator coordinator.Coordinator
 
 	// frequency tells the processor how often to check the state of plots
 	frequency time.Duration
@@ -44,29 +59,105 @@ type Processor struct {
 	// location before using the next one
 	plotDirs []string
 
+	// mu guards schedule, retries and reservations, which process() (the
+	// processor's own goroutine) and snapshot() (called periodically from the
+	// stateStore.Run goroutine started in Start()) both read and write
+	mu sync.Mutex
+
 	// schedule tells us when to check for plots
 	schedule map[string]time.Time
 
+	// retries counts, per plot ID, how many times its download has failed and
+	// been retried. It's persisted through stateStore so it survives restarts
+	retries map[string]int
+
 	// maxDownloads is the maximum number of parallel downloads
 	maxDownloads int
+
+	// stateStore persists proc.schedule and proc.retries to disk, if configured,
+	// so a restart doesn't have to reprobe every plot in the order from scratch
+	stateStore *state.Store
+
+	// diskMgr tracks, per plotDir, how many bytes have already been set aside
+	// for plots that are about to download but haven't written them to disk yet.
+	// Without it, two goroutines racing to pick a directory (eg: this Processor's
+	// own loop and proc.coordinator's claim negotiation) could both see the same
+	// free space and overcommit it
+	diskMgr *disk.Manager
+
+	// reservations tracks, per plot ID, the diskMgr reservation backing its
+	// download directory, so it can be released once the plot is done with it
+	reservations map[string]disk.ReservationID
 }
 
+// getAvailableSpace reports how much space in plotDir is free for a new plot to
+// use, after accounting for what proc.diskMgr has already reserved there
 func (proc *Processor) getAvailableSpace(plotDir string) (int64, error) {
-	available, _, err := disk.GetAvailableSpace(plotDir)
+	space, err := proc.diskMgr.GetAvailableSpace(plotDir)
 	if err != nil {
 		return 0, err
 	}
+	return int64(space.FreeForNew), nil
+}
 
-	for _, plot := range proc.plots {
-		if plot.GetDownloadDirectory() == "" {
-			continue
-		}
-		if plot.GetDownloadDirectory() == plotDir {
-			remaining := plot.GetRemainingBytes()
-			available -= uint64(remaining)
-		}
+// reserveSpace records that p has claimed bytes in plotDir, so concurrent calls
+// to getAvailableSpace no longer offer them to another plot
+func (proc *Processor) reserveSpace(p *plot.Plot, plotDir string, bytes int64) error {
+	id, err := proc.diskMgr.Reserve(plotDir, bytes)
+	if err != nil {
+		return err
 	}
-	return int64(available), nil
+
+	proc.mu.Lock()
+	proc.reservations[p.ID] = id
+	proc.mu.Unlock()
+	return nil
+}
+
+// releaseSpace gives up the diskMgr reservation (if any) held for p, eg: because
+// its download finished or it was cancelled
+func (proc *Processor) releaseSpace(p *plot.Plot) {
+	proc.mu.Lock()
+	id, ok := proc.reservations[p.ID]
+	if ok {
+		delete(proc.reservations, p.ID)
+	}
+	proc.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	proc.diskMgr.Release(id)
+}
+
+// scheduleFor reports when p should next be checked, and whether it's
+// scheduled to be checked at all
+func (proc *Processor) scheduleFor(id string) (time.Time, bool) {
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+	s, ok := proc.schedule[id]
+	return s, ok
+}
+
+// setSchedule records when a plot should next be checked
+func (proc *Processor) setSchedule(id string, t time.Time) {
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+	proc.schedule[id] = t
+}
+
+// clearSchedule stops a plot from being checked again
+func (proc *Processor) clearSchedule(id string) {
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+	delete(proc.schedule, id)
+}
+
+// incrRetries records another failed download/validation attempt for a plot
+func (proc *Processor) incrRetries(id string) {
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+	proc.retries[id]++
 }
 
 func (proc *Processor) getPlotDownloadDirectory(p *plot.Plot) (string, error) {
@@ -96,6 +187,10 @@ func (proc *Processor) getPlotDownloadDirectory(p *plot.Plot) (string, error) {
 			return "", ErrNotEnoughSpace
 		}
 
+		if err := proc.reserveSpace(p, plotDir, remaining); err != nil {
+			return "", err
+		}
+
 		log.Infof("%s resuming %s from existing file in %s (available=%s, remaining=%s)", proc, p.ID, plotDir, humanize.Bytes(uint64(available)), humanize.Bytes(uint64(remaining)))
 		return plotDir, nil
 	}
@@ -113,6 +208,10 @@ func (proc *Processor) getPlotDownloadDirectory(p *plot.Plot) (string, error) {
 			continue
 		}
 
+		if err := proc.reserveSpace(p, plotDir, p.GetDownloadSize()); err != nil {
+			return "", err
+		}
+
 		log.Infof("%s %s has enough space to start downloading %s (available=%s, plot_size=%s)", proc, plotDir, p.ID, humanize.Bytes(uint64(available)), humanize.Bytes(uint64(p.GetDownloadSize())))
 		return plotDir, nil
 	}
@@ -121,6 +220,120 @@ func (proc *Processor) getPlotDownloadDirectory(p *plot.Plot) (string, error) {
 	return "", ErrNotEnoughSpace
 }
 
+// SetCoordinator makes this Processor cooperate with other plotorder instances
+// (through c) when deciding which of them should download a given plot
+func (proc *Processor) SetCoordinator(c coordinator.Coordinator) {
+	proc.coordinator = c
+}
+
+// SetStateStore makes this Processor persist its schedule and retry counters to
+// s, so a restart doesn't have to reprobe every plot in the order from scratch
+func (proc *Processor) SetStateStore(s *state.Store) {
+	proc.stateStore = s
+}
+
+// snapshot builds the state.Snapshot to be persisted by proc.stateStore
+func (proc *Processor) snapshot() *state.Snapshot {
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+
+	snap := state.NewSnapshot()
+	for _, p := range proc.plots {
+		var reservedBytes int64
+		if id, ok := proc.reservations[p.ID]; ok {
+			reservedBytes = proc.diskMgr.Bytes(id)
+		}
+
+		snap.Plots[p.ID] = state.PlotState{
+			NextCheckAt:       proc.schedule[p.ID],
+			DownloadDirectory: p.GetDownloadDirectory(),
+			DownloadedBytes:   p.GetDownloadedBytes(),
+			Retries:           proc.retries[p.ID],
+			ReservedBytes:     reservedBytes,
+		}
+	}
+	return snap
+}
+
+// restoreState re-applies a previously saved state.Snapshot to proc.plots, so
+// plots don't all get checked against the API the moment plotorder restarts. A
+// plot's entry is only trusted if its recorded DownloadDirectory still holds a
+// file of the recorded size; otherwise the download has since changed shape
+// (eg: it was deleted, or the run that wrote the entry never saw it finish
+// writing) and we fall back to reprobing it, same as before the cache existed
+func (proc *Processor) restoreState(snap *state.Snapshot) {
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+
+	for _, p := range proc.plots {
+		ps, ok := snap.Plots[p.ID]
+		if !ok {
+			continue
+		}
+
+		if ps.DownloadDirectory != "" {
+			filename, err := p.ExpectedFilename()
+			if err != nil {
+				continue
+			}
+
+			fInfo, err := os.Stat(path.Join(ps.DownloadDirectory, filename))
+			if err != nil || fInfo.Size() != ps.DownloadedBytes {
+				log.Debugf("%s cached state for %s disagrees with what's on disk, will reprobe it", proc, p.ID)
+				continue
+			}
+		}
+
+		proc.schedule[p.ID] = ps.NextCheckAt
+		proc.retries[p.ID] = ps.Retries
+	}
+}
+
+// Status reports this Processor's free space per plotDir and how many transfers
+// it currently has in flight. It's meant to be passed to coordinator.NewNATSCoordinator
+// so other instances can take this one's load into account when negotiating a claim
+func (proc *Processor) Status() (freeSpace map[string]int64, activeTransfers int) {
+	freeSpace = proc.freeSpaceByDirectory()
+	if proc.transfers != nil {
+		activeTransfers = proc.transfers.Active()
+	}
+	return freeSpace, activeTransfers
+}
+
+// freeSpaceByDirectory reports the free space currently available in each of
+// proc.plotDirs, to be sent to the coordinator as part of a claim request
+func (proc *Processor) freeSpaceByDirectory() map[string]int64 {
+	freeSpace := map[string]int64{}
+	for _, plotDir := range proc.plotDirs {
+		available, err := proc.getAvailableSpace(plotDir)
+		if err != nil {
+			log.Warnf("%s error while checking available space in %s: %s", proc, plotDir, err)
+			continue
+		}
+		freeSpace[plotDir] = available
+	}
+	return freeSpace
+}
+
+// observeTransfer forwards t's progress to proc.reporter as soon as the
+// transfer manager reports it, instead of waiting for the next process() tick
+// to notice p's downloaded byte count changed. It returns once t finishes, since
+// process() picks up the resulting state change (DownloadStateFailed or
+// DownloadStateDownloaded) on its own
+func (proc *Processor) observeTransfer(p *plot.Plot, t *xfer.Transfer) {
+	for {
+		select {
+		case progress, ok := <-t.Progress():
+			if !ok {
+				return
+			}
+			proc.reporter.UpdatePlot(p.ID, progress.BytesDownloaded, "downloading")
+		case <-t.Done():
+			return
+		}
+	}
+}
+
 func (proc *Processor) isDownloadAllowed() bool {
 	if proc.maxDownloads == 0 {
 		return true
@@ -139,7 +352,7 @@ func (proc *Processor) process(ctx context.Context) (bool, error) {
 	for i := range proc.plots {
 		p := proc.plots[i]
 
-		s, ok := proc.schedule[p.ID]
+		s, ok := proc.scheduleFor(p.ID)
 		// if it's not here, it means we don't have to check any longer
 		if !ok {
 			continue
@@ -182,27 +395,41 @@ func (proc *Processor) process(ctx context.Context) (bool, error) {
 			case plot.DownloadStateLookingForDownloadLocation:
 				log.Debugf("%s looking for an available download directory for %s", proc, p.ID)
 
+				claim, err := proc.coordinator.Claim(ctx, p.ID, proc.freeSpaceByDirectory())
+				if err != nil {
+					log.Warnf("%s error while claiming %s, will try again (%s)", proc, p.ID, err)
+					break
+				}
+				if !claim.Won {
+					log.Debugf("%s %s was claimed by another instance, will check again later", proc, p.ID)
+					nextScheduleTime = now.Add(30 * time.Second)
+					break
+				}
+
 				plotDir, err := proc.getPlotDownloadDirectory(p)
 				if err == ErrNotEnoughSpace {
 					log.Errorf("%s please make room to download this plot", p)
 					p.SetDownloadError()
+					proc.coordinator.Release(p.ID)
 				} else if err != nil {
 					log.Errorf("%s unexpected error while retrieving verification hashes (%s)", p, err)
 					p.SetDownloadError()
+					proc.coordinator.Release(p.ID)
 				} else {
 					p.SetDownloadDirectory(plotDir)
 				}
 			case plot.DownloadStateWaitingForHashes:
 				log.Debugf("%s waiting get the plot verification hashes", p)
 
-				hashList, err := proc.client.GetHashesForPlot(ctx, p.ID)
+				manifest, err := proc.client.GetHashesForPlot(ctx, p.ID)
 				if err == client.ErrPlotHashesNotReady {
 					log.Warnf("%s verification hashes still not ready. Waiting for chiafactory to calculate them", p)
 				} else if err != nil {
 					log.Errorf("%s unexpected error while retrieving verification hashes (%s)", p, err)
 					p.SetDownloadError()
-				} else {
-					p.SetFileHashes(hashList)
+				} else if err := p.SetFileHashes(manifest); err != nil {
+					log.Errorf("%s verification hashes failed their signature check (%s)", p, err)
+					p.SetDownloadError()
 				}
 			case plot.DownloadStateNotStarted:
 				go func() {
@@ -213,21 +440,35 @@ func (proc *Processor) process(ctx context.Context) (bool, error) {
 				}()
 			case plot.DownloadStatePreparing:
 				log.Debugf("%s is being prepared for download", p)
+				proc.reporter.UpdatePlot(p.ID, p.GetDownloadedBytes(), "preparing")
 			case plot.DownloadStateReady:
 				nextScheduleTime = now.Add(10 * time.Minute)
-				proc.downloads.Add(1)
-				go func() {
-					defer proc.downloads.Done()
-					p.Download(ctx)
-				}()
+				proc.reporter.AddPlot(p)
+				if t := proc.transfers.Submit(p); t != nil {
+					go proc.observeTransfer(p, t)
+				}
+			case plot.DownloadStateResuming:
+				log.Debugf("%s resuming from %s already on disk", p, humanize.Bytes(uint64(p.GetDownloadedBytes())))
+				proc.reporter.UpdatePlot(p.ID, p.GetDownloadedBytes(), "resuming")
 			case plot.DownloadStateDownloading:
 				log.Debugf("%s downloading (progress=%s)", p, p.GetDownloadProgress())
+				proc.reporter.UpdatePlot(p.ID, p.GetDownloadedBytes(), "downloading")
 			case plot.DownloadStateFailed:
-				log.Debugf("%s download failed. We'll retry it", p)
-				p.RetryDownload(ctx)
+				log.Debugf("%s download failed. The transfer manager will retry it", p)
+				proc.incrRetries(p.ID)
+				// a failure in PrepareDownload never reached the transfer manager,
+				// so hand the plot over now; Submit is a no-op while one is in flight
+				proc.reporter.AddPlot(p)
+				if t := proc.transfers.Submit(p); t != nil {
+					go proc.observeTransfer(p, t)
+				}
+				proc.reporter.UpdatePlot(p.ID, p.GetDownloadedBytes(), "failed")
 			case plot.DownloadStateDownloaded:
 				nextScheduleTime = now.Add(1 * time.Minute)
 				log.Debugf("%s download finished, marking it as expired", p)
+				proc.reporter.RemovePlot(p.ID)
+				proc.coordinator.Release(p.ID)
+				proc.releaseSpace(p)
 				dp, err := proc.client.DeletePlot(ctx, p.ID)
 				if err != nil {
 					log.Errorf("%s failed to delete plot (%s). Retrying soon", p, err)
@@ -236,11 +477,20 @@ func (proc *Processor) process(ctx context.Context) (bool, error) {
 				}
 			case plot.DownloadStateLiveValidation:
 				log.Debugf("%s is validating the latest chunk", p)
+				proc.reporter.UpdatePlot(p.ID, p.GetDownloadedBytes(), "validating")
 			case plot.DownloadStateInitialValidation:
 				log.Debugf("%s is validating the last chunk before resuming", p)
+				proc.reporter.UpdatePlot(p.ID, p.GetDownloadedBytes(), "validating")
 			case plot.DownloadStateFailedValidation:
-				log.Debugf("%s validation for the last chunk failed. We'll re-download it", p)
-				p.RetryDownload(ctx)
+				log.Debugf("%s validation for the last chunk failed. The transfer manager will retry it", p)
+				proc.incrRetries(p.ID)
+				// a failed initial validation (in PrepareDownload) never reached the
+				// transfer manager, so hand the plot over now, as above
+				proc.reporter.AddPlot(p)
+				if t := proc.transfers.Submit(p); t != nil {
+					go proc.observeTransfer(p, t)
+				}
+				proc.reporter.UpdatePlot(p.ID, p.GetDownloadedBytes(), "failed")
 
 			case plot.DownloadStateEnqueued, "":
 				if p.DownloadURL == "" && newP.DownloadURL != "" {
@@ -262,14 +512,16 @@ func (proc *Processor) process(ctx context.Context) (bool, error) {
 			}
 		case plot.StateCancelled, plot.StateExpired:
 			log.Debugf("%s is expired or cancelled", p)
-			delete(proc.schedule, p.ID)
+			proc.reporter.RemovePlot(p.ID)
+			proc.releaseSpace(p)
+			proc.clearSchedule(p.ID)
 			updateSchedule = false
 		default:
 			return false, fmt.Errorf("unexpected state (%s)", p.State)
 		}
 
 		if updateSchedule {
-			proc.schedule[p.ID] = nextScheduleTime
+			proc.setSchedule(p.ID, nextScheduleTime)
 			log.Debugf("%s will be checked again at %s", p, nextScheduleTime)
 		}
 	}
@@ -285,8 +537,6 @@ func (proc *Processor) process(ctx context.Context) (bool, error) {
 		return true, nil
 	}
 
-	proc.reporter.render(proc.plots)
-
 	return false, nil
 }
 
@@ -294,6 +544,21 @@ func (proc *Processor) Start(ctx context.Context, orderID string) (err error) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	proc.transfers = xfer.NewManager(ctx, xfer.Options{MaxDownloads: proc.maxDownloads})
+
+	heartbeat := time.NewTicker(heartbeatFrequency)
+	go func() {
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-heartbeat.C:
+				proc.coordinator.Heartbeat(ctx)
+			}
+		}
+	}()
+
 	ticker := time.NewTicker(proc.frequency)
 
 	order, err := proc.client.GetOrder(ctx, orderID)
@@ -309,7 +574,18 @@ func (proc *Processor) Start(ctx context.Context, orderID string) (err error) {
 	proc.plots = plots
 
 	for _, p := range proc.plots {
-		proc.schedule[p.ID] = time.Time{}
+		proc.setSchedule(p.ID, time.Time{})
+	}
+
+	if proc.stateStore != nil {
+		proc.restoreState(proc.stateStore.Load())
+
+		stopState := make(chan struct{})
+		go proc.stateStore.Run(stopState, stateSaveFrequency, proc.snapshot)
+		go func() {
+			<-ctx.Done()
+			close(stopState)
+		}()
 	}
 
 	log.Infof("%s %s has %d plots", proc, order, len(plots))
@@ -327,23 +603,23 @@ func (proc *Processor) Start(ctx context.Context, orderID string) (err error) {
 			select {
 			case <-ctx.Done():
 				// wait for all the downloads to finish
-				proc.downloads.Wait()
+				proc.transfers.Wait()
 				return
 			case <-ticker.C:
 				// raise warnings about remaining disk space
 				for _, plotDir := range proc.plotDirs {
-					available, _, err := disk.GetAvailableSpace(plotDir)
+					space, err := proc.diskMgr.GetAvailableSpace(plotDir)
 					if err != nil {
 						log.Warnf("%s error while checking available space in %s: %s", proc, plotDir, err)
 						continue
 					}
 
-					if available == 0 {
+					if space.FreeForNew == 0 {
 						log.Warnf("%s %s has no remaining space. All downloads will be stopped and the program will exit", proc, plotDir)
 						cancel()
 						return
-					} else if available <= uint64(minAvailableSpaceThreshold) {
-						log.Warnf("%s %s is running out of space (remaining=%s)", proc, plotDir, humanize.Bytes(available))
+					} else if space.FreeForNew <= minAvailableSpaceThreshold {
+						log.Warnf("%s %s is running out of space (remaining=%s)", proc, plotDir, humanize.Bytes(space.FreeForNew))
 					}
 				}
 
@@ -374,15 +650,18 @@ func (proc *Processor) String() string {
 	return "[processor]"
 }
 
-func NewProcessor(c *client.Client, r *Reporter, plotDirs []string, frequency time.Duration, maxDownloads int) (*Processor, error) {
+func NewProcessor(c *client.Client, r Reporter, plotDirs []string, frequency time.Duration, maxDownloads int) (*Processor, error) {
 	p := &Processor{
 		client:       c,
 		reporter:     r,
-		downloads:    sync.WaitGroup{},
 		frequency:    frequency,
 		plotDirs:     plotDirs,
 		schedule:     map[string]time.Time{},
+		retries:      map[string]int{},
 		maxDownloads: maxDownloads,
+		coordinator:  coordinator.NoopCoordinator{},
+		diskMgr:      disk.NewManager(),
+		reservations: map[string]disk.ReservationID{},
 	}
 	return p, nil
 }
@@ -2,192 +2,647 @@ package processor
 
 import (
 	"chiafactory/plotorder/plot"
+	"encoding/json"
 	"fmt"
 	"io"
-	"sort"
+	"os"
+	"sync"
 	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/fatih/color"
-	"github.com/gosuri/uilive"
-	"github.com/olekukonko/tablewriter"
-)
-
-const (
-	pendingColour   = tablewriter.FgYellowColor
-	plottingColour  = tablewriter.FgBlueColor
-	publishedColour = tablewriter.FgGreenColor
-	expiredColour   = tablewriter.FgMagentaColor
-	cancelledColour = tablewriter.FgMagentaColor
-	unknownColour   = tablewriter.BgRedColor
-	errorColour     = tablewriter.FgRedColor
+	log "github.com/sirupsen/logrus"
+	"github.com/vbauerster/mpb/v7"
+	"github.com/vbauerster/mpb/v7/decor"
+	"golang.org/x/term"
 )
 
 var (
-	cyan    = color.New(color.FgCyan)
-	yellow  = color.New(color.FgYellow)
-	magenta = color.New(color.FgMagenta)
-	blue    = color.New(color.FgBlue)
-	green   = color.New(color.FgGreen)
+	preparingColour   = color.New(color.FgYellow).SprintFunc()
+	downloadingColour = color.New(color.FgBlue).SprintFunc()
+	validatingColour  = color.New(color.FgCyan).SprintFunc()
+	failedStateColour = color.New(color.FgRed).SprintFunc()
 )
 
-func printSectionTitle(writer io.Writer, title string) {
-	fmt.Fprintf(writer, "\n- %s\n\n", title)
+// Reporter renders the live status of a Processor's plots: one progress bar per
+// plot currently downloading, plus an aggregate bar for the whole order. It's
+// used both as a log destination (in cmd/root.go) and by the Processor, which
+// drives AddPlot/UpdatePlot/RemovePlot as plots move through their download
+// states. The default implementation falls back to plain line logging when
+// stdout isn't a terminal, so piping plotorder's output or writing it to a log
+// file through lumberjack stays readable
+type Reporter interface {
+	io.Writer
+
+	Start()
+	Stop()
+
+	// AddPlot starts tracking p, giving it its own progress bar
+	AddPlot(p *plot.Plot)
+
+	// UpdatePlot reports id's latest downloaded byte count and state (one of
+	// "preparing", "resuming", "downloading", "validating" or "failed"). A state of "failed"
+	// recolours the bar and counts as a retry
+	UpdatePlot(id string, bytes int64, state string)
+
+	// RemovePlot stops tracking id, eg: because its download finished, or the
+	// plot was cancelled or expired
+	RemovePlot(id string)
 }
 
-type row struct {
-	sortKey int
-	data    []string
-	colour  int
+// NewReporter creates the default Reporter: a multi progress-bar renderer when
+// stdout is a terminal, or a plain line-based logger otherwise
+func NewReporter() Reporter {
+	if term.IsTerminal(int(os.Stdout.Fd())) {
+		return newBarReporter()
+	}
+	return newLineReporter()
 }
 
-func NewReporter() *Reporter {
-	w := uilive.New()
-	w.RefreshInterval = 500 * time.Millisecond
-	s := time.Now()
-	return &Reporter{
-		w: w,
-		s: s,
+func stateLabel(state string) string {
+	switch state {
+	case "preparing":
+		return preparingColour("preparing")
+	case "resuming":
+		return downloadingColour("resuming")
+	case "downloading":
+		return downloadingColour("downloading")
+	case "validating":
+		return validatingColour("validating")
+	case "failed":
+		return failedStateColour("failed")
+	default:
+		return state
 	}
 }
 
-type Reporter struct {
-	w             *uilive.Writer
-	s             time.Time
-	disableStdout bool
+// plotBar is the live status of a single plot's bar, shared between the bar's
+// decorators (read on every redraw) and AddPlot/UpdatePlot/RemovePlot (which
+// update it under barReporter.mu)
+type plotBar struct {
+	bar     *mpb.Bar
+	bytes   int64
+	state   string
+	retries int
+}
+
+// barReporter is the Reporter used when stdout is a terminal: it draws one mpb
+// bar per plot being downloaded, plus an aggregate bar for the whole order
+type barReporter struct {
+	progress *mpb.Progress
+	total    *mpb.Bar
+	agg      *aggTracker
+
+	mu   sync.Mutex
+	bars map[string]*plotBar
+
+	// orderTotal is the sum of the sizes of every plot added so far, used as
+	// the total of the "order total" bar
+	orderTotal int64
+
+	started bool
+}
+
+func newBarReporter() *barReporter {
+	r := &barReporter{
+		progress: mpb.New(mpb.WithWidth(40), mpb.WithRefreshRate(500*time.Millisecond)),
+		bars:     map[string]*plotBar{},
+		agg:      newAggTracker(),
+	}
+
+	r.total = r.progress.AddBar(0,
+		mpb.BarFillerClearOnComplete(),
+		mpb.PrependDecorators(decor.Name("order total", decor.WC{W: 15})),
+		mpb.AppendDecorators(
+			decor.CountersKibiByte("% .2f / % .2f"),
+			decor.Name(" "),
+			decor.AverageSpeed(decor.UnitKiB, "% .2f"),
+			decor.Any(func(decor.Statistics) string {
+				r.mu.Lock()
+				stats := r.agg.snapshot()
+				r.mu.Unlock()
+				if stats.ETA == 0 {
+					return ""
+				}
+				return fmt.Sprintf(" eta %s", stats.ETA.Round(time.Second))
+			}),
+			decor.Any(func(decor.Statistics) string {
+				r.mu.Lock()
+				dropped := r.agg.droppedBytes
+				r.mu.Unlock()
+				if dropped == 0 {
+					return ""
+				}
+				return fmt.Sprintf(" (dropped %s)", humanize.Bytes(uint64(dropped)))
+			}),
+		),
+	)
+
+	return r
 }
 
-func (r *Reporter) Write(b []byte) (n int, err error) {
-	if r.disableStdout {
+// Write lets barReporter double as the destination lumberjack's MultiWriter
+// logs to. Once the bars own the terminal, anything else written our way would
+// corrupt the display, so it's swallowed, the same way the table-based reporter
+// this replaced used to disable its own stdout passthrough after its first render
+func (r *barReporter) Write(b []byte) (n int, err error) {
+	if r.started {
 		return len(b), nil
 	}
-	fmt.Printf(string(b))
-	return len(b), nil
+	return fmt.Print(string(b))
 }
 
-func (r *Reporter) Start() {
-	r.w.Start()
+func (r *barReporter) Start() {
+	r.started = true
 }
 
-func (r *Reporter) Stop() {
-	r.w.Stop()
+func (r *barReporter) Stop() {
+	r.progress.Wait()
 }
 
-func (r *Reporter) render(plots []*plot.Plot) {
-	// disable stdout writes in the first render
-	if !r.disableStdout {
-		r.disableStdout = true
+func (r *barReporter) AddPlot(p *plot.Plot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.bars[p.ID]; ok {
+		return
 	}
 
-	now := time.Now()
-	elapsed := now.Sub(r.s).Round(time.Second)
-
-	rows := []row{}
-	table := tablewriter.NewWriter(r.w)
-	table.SetHeader([]string{"Plot", "State", "Progress", "Speed", "Download Directory"})
-	table.SetAutoFormatHeaders(false)
-	table.SetBorders(tablewriter.Border{Left: true, Top: false, Right: true, Bottom: false})
-	table.SetCenterSeparator("+")
-	table.SetColMinWidth(0, 10)
-	table.SetColMinWidth(1, 30)
-	table.SetColMinWidth(2, 10)
-	table.SetColMinWidth(3, 10)
-	table.SetColMinWidth(3, 15)
-	table.SetColumnAlignment([]int{tablewriter.ALIGN_CENTER, tablewriter.ALIGN_CENTER, tablewriter.ALIGN_CENTER, tablewriter.ALIGN_CENTER, tablewriter.ALIGN_CENTER})
-
-	var (
-		pending     = 0
-		downloading = 0
-		plotting    = 0
-		cancelled   = 0
-		expired     = 0
-		unknown     = 0
+	total := p.GetDownloadSize()
+	pb := &plotBar{state: "preparing"}
+
+	r.agg.add(p.ID, total)
+	r.orderTotal += total
+	r.total.SetTotal(r.orderTotal, false)
+
+	pb.bar = r.progress.AddBar(total,
+		mpb.PrependDecorators(
+			decor.Name(p.GetDownloadFilename(), decor.WCSyncWidthR),
+			decor.Any(func(decor.Statistics) string { return stateLabel(pb.state) }, decor.WCSyncWidth),
+		),
+		mpb.AppendDecorators(
+			decor.CountersKibiByte("% .2f / % .2f"),
+			decor.Name(" "),
+			decor.AverageETA(decor.ET_STYLE_MMSS),
+			decor.Any(func(decor.Statistics) string {
+				if pb.retries == 0 {
+					return ""
+				}
+				return fmt.Sprintf(" (retries=%d)", pb.retries)
+			}),
+		),
 	)
+	r.bars[p.ID] = pb
+}
 
-	for _, p := range plots {
-		switch p.State {
-		case plot.StatePending:
-			pending++
-		case plot.StatePlotting:
-			plotting++
-			rows = append(rows, row{1, []string{p.ID, "Plotting", p.GetPlottingProgress(), "-", "-"}, plottingColour})
-		case plot.StatePublished:
-			downloading++
-
-			if p.HasDownloadError() {
-				rows = append(rows, row{0, []string{p.ID, "Error, please check logs", "-", "-", "-"}, errorColour})
-				continue
-			}
+func (r *barReporter) UpdatePlot(id string, bytes int64, state string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pb, ok := r.bars[id]
+	if !ok {
+		return
+	}
+
+	if state == "failed" {
+		pb.retries++
+	}
+	pb.state = state
+
+	r.agg.update(id, bytes)
+
+	delta := bytes - pb.bytes
+	pb.bytes = bytes
+	if delta <= 0 {
+		return
+	}
+
+	pb.bar.IncrInt64(delta)
+	r.total.IncrInt64(delta)
+}
+
+func (r *barReporter) RemovePlot(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pb, ok := r.bars[id]
+	if !ok {
+		return
+	}
+	pb.bar.Abort(true)
+	delete(r.bars, id)
+	r.agg.remove(id)
+}
+
+// aggEWMAAlpha weights each tick's instantaneous download rate against the
+// smoothed rate carried over from the previous tick, so a burst or stall in one
+// interval doesn't make AggStats.DownloadRate jump around
+const aggEWMAAlpha = 0.3
 
-			switch p.GetDownloadState() {
-			case plot.DownloadStateNotStarted:
-				rows = append(rows, row{0, []string{p.ID, "Download pending", "-", "-", p.GetDownloadDirectory()}, publishedColour})
-			case plot.DownloadStateReady:
-				rows = append(rows, row{0, []string{p.ID, "Ready to download", "-", "-", p.GetDownloadDirectory()}, publishedColour})
-			case plot.DownloadStatePreparing:
-				rows = append(rows, row{0, []string{p.ID, "Preparing download", "-", "-", p.GetDownloadDirectory()}, publishedColour})
-			case plot.DownloadStateInitialValidation:
-				rows = append(rows, row{0, []string{p.ID, "Validating before resuming", "-", "-", p.GetDownloadDirectory()}, publishedColour})
-			case plot.DownloadStateDownloading:
-				rows = append(rows, row{0, []string{p.ID, "Downloading", p.GetDownloadProgress(), p.GetDownloadSpeed(), p.GetDownloadDirectory()}, publishedColour})
-			case plot.DownloadStateFailed:
-				rows = append(rows, row{0, []string{p.ID, "Download failed", "-", "-", p.GetDownloadDirectory()}, publishedColour})
-			case plot.DownloadStateFailedValidation:
-				rows = append(rows, row{0, []string{p.ID, "Validation failed, re-downloading", "-", "-", p.GetDownloadDirectory()}, publishedColour})
-			case plot.DownloadStateLiveValidation:
-				rows = append(rows, row{0, []string{p.ID, "Downloading (and validating)", p.GetDownloadProgress(), p.GetDownloadSpeed(), p.GetDownloadDirectory()}, publishedColour})
-			case plot.DownloadStateDownloaded:
-				rows = append(rows, row{0, []string{p.ID, "Downloaded", p.GetDownloadProgress(), p.GetDownloadSpeed(), p.GetDownloadDirectory()}, publishedColour})
-			case plot.DownloadStateLookingForDownloadLocation:
-				rows = append(rows, row{0, []string{p.ID, "Looking for download location", "-", "-", p.GetDownloadDirectory()}, publishedColour})
-			case plot.DownloadStateWaitingForHashes:
-				rows = append(rows, row{0, []string{p.ID, "Waiting for hashes", "-", "-", p.GetDownloadDirectory()}, publishedColour})
-			case plot.DownloadStateEnqueued:
-				rows = append(rows, row{0, []string{p.ID, "Download enqueued", "-", "-", p.GetDownloadDirectory()}, publishedColour})
-			default:
-				rows = append(rows, row{0, []string{p.ID, "Pending", "-", "-", "-"}, publishedColour})
+// AggStats is a point-in-time snapshot of an order's overall download progress,
+// modeled after erigon's AggStats so the plain-text summary line and the
+// jsonReporter stream can share the same numbers. It has a single DroppedBytes
+// counter rather than erigon's DroppedCompleted/DroppedTotal pair: this codebase
+// has no notion of a planned total for re-downloaded bytes, just a running count
+// of how many have had to be thrown away and re-fetched after a failed
+// validation
+type AggStats struct {
+	BytesCompleted int64
+	BytesTotal     int64
+	BytesDownload  int64
+	DownloadRate   float64
+	DroppedBytes   int64
+	ETA            time.Duration
+}
+
+type aggPlot struct {
+	bytes int64
+	total int64
+}
+
+// aggTracker computes an EWMA-smoothed AggStats from the same bytes/state
+// AddPlot/UpdatePlot/RemovePlot already report, so lineReporter and jsonReporter
+// (neither of which gets an aggregate row for free the way barReporter's "order
+// total" bar does) can show one. A plot's downloaded bytes going backwards
+// between two updates only happens when Download truncates the file after a
+// failed validation, so that's how dropped bytes are detected
+type aggTracker struct {
+	plots         map[string]*aggPlot
+	droppedBytes  int64
+	lastCompleted int64
+	lastAt        time.Time
+	rate          float64
+}
+
+func newAggTracker() *aggTracker {
+	return &aggTracker{plots: map[string]*aggPlot{}, lastAt: time.Now()}
+}
+
+func (a *aggTracker) add(id string, total int64) {
+	if _, ok := a.plots[id]; ok {
+		return
+	}
+	a.plots[id] = &aggPlot{total: total}
+}
+
+func (a *aggTracker) update(id string, bytes int64) {
+	ap, ok := a.plots[id]
+	if !ok {
+		return
+	}
+	if bytes < ap.bytes {
+		a.droppedBytes += ap.bytes - bytes
+	}
+	ap.bytes = bytes
+}
+
+func (a *aggTracker) remove(id string) {
+	delete(a.plots, id)
+}
+
+// snapshot returns the current AggStats, folding the bytes completed since the
+// last call into the EWMA rate
+func (a *aggTracker) snapshot() AggStats {
+	var completed, total int64
+	for _, ap := range a.plots {
+		completed += ap.bytes
+		total += ap.total
+	}
+
+	now := time.Now()
+	elapsed := now.Sub(a.lastAt).Seconds()
+	downloaded := completed - a.lastCompleted
+	a.lastCompleted = completed
+	a.lastAt = now
+
+	if elapsed > 0 {
+		instant := float64(downloaded) / elapsed
+		a.rate = aggEWMAAlpha*instant + (1-aggEWMAAlpha)*a.rate
+	}
+
+	stats := AggStats{
+		BytesCompleted: completed,
+		BytesTotal:     total,
+		BytesDownload:  downloaded,
+		DownloadRate:   a.rate,
+		DroppedBytes:   a.droppedBytes,
+	}
+	if a.rate > 0 {
+		stats.ETA = time.Duration(float64(total-completed)/a.rate) * time.Second
+	}
+	return stats
+}
+
+// lineReporter is the Reporter used when stdout isn't a terminal: a systemd
+// journal, a pipe, or a Windows console without VT support would all show mangled
+// output from barReporter's ANSI redraws. It logs one line for every plot update
+// it receives, plus a periodic aggregate summary line, through logrus instead, the same way
+// the rest of plotorder logs, so it reads like any other line in the log file
+type lineReporter struct {
+	mu   sync.Mutex
+	agg  *aggTracker
+	stop chan struct{}
+}
+
+func newLineReporter() *lineReporter {
+	return &lineReporter{agg: newAggTracker()}
+}
+
+func (r *lineReporter) Write(b []byte) (n int, err error) {
+	return fmt.Print(string(b))
+}
+
+func (r *lineReporter) Start() {
+	r.stop = make(chan struct{})
+
+	ticker := time.NewTicker(jsonStreamInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				r.printSummary()
 			}
-		case plot.StateCancelled:
-			cancelled++
-		case plot.StateExpired:
-			expired++
-		default:
-			unknown++
 		}
+	}()
+}
+
+func (r *lineReporter) Stop() {
+	close(r.stop)
+}
+
+func (r *lineReporter) printSummary() {
+	r.mu.Lock()
+	stats := r.agg.snapshot()
+	r.mu.Unlock()
+
+	if stats.BytesTotal == 0 {
+		return
+	}
+
+	log.Infof("order: %s / %s downloaded (%s/s, eta %s, dropped %s)",
+		humanize.Bytes(uint64(stats.BytesCompleted)), humanize.Bytes(uint64(stats.BytesTotal)),
+		humanize.Bytes(uint64(stats.DownloadRate)), stats.ETA.Round(time.Second), humanize.Bytes(uint64(stats.DroppedBytes)))
+}
+
+func (r *lineReporter) AddPlot(p *plot.Plot) {
+	r.mu.Lock()
+	_, alreadyAdded := r.agg.plots[p.ID]
+	r.agg.add(p.ID, p.GetDownloadSize())
+	r.mu.Unlock()
+
+	if alreadyAdded {
+		return
 	}
 
-	// sort the table rows
-	sort.Slice(rows, func(i, j int) bool {
-		a := rows[i].sortKey
-		b := rows[j].sortKey
+	log.Infof("%s: starting download (%s)", p.ID, humanize.Bytes(uint64(p.GetDownloadSize())))
+}
+
+func (r *lineReporter) UpdatePlot(id string, bytes int64, state string) {
+	r.mu.Lock()
+	r.agg.update(id, bytes)
+	r.mu.Unlock()
+
+	log.Infof("%s: %s (%s downloaded)", id, state, humanize.Bytes(uint64(bytes)))
+}
+
+func (r *lineReporter) RemovePlot(id string) {
+	r.mu.Lock()
+	r.agg.remove(id)
+	r.mu.Unlock()
+
+	log.Infof("%s: done", id)
+}
+
+// jsonStreamInterval is how often jsonReporter writes an event while plots are
+// being tracked
+const jsonStreamInterval = 1 * time.Second
+
+// jsonPlot is one plot's entry in a jsonEvent
+type jsonPlot struct {
+	ID             string  `json:"id"`
+	DownloadState  string  `json:"download_state"`
+	BytesCompleted int64   `json:"bytes_completed"`
+	BytesTotal     int64   `json:"bytes_total"`
+	Progress       float64 `json:"progress"`
+	SpeedBps       float64 `json:"speed_bps"`
+	DownloadDir    string  `json:"download_dir"`
+	Error          string  `json:"error,omitempty"`
+}
+
+// jsonSummary is the top-level counts included in every jsonEvent
+type jsonSummary struct {
+	Plots    int     `json:"plots"`
+	Failed   int     `json:"failed"`
+	ElapsedS float64 `json:"elapsed_s"`
 
-		if a == b {
-			return rows[i].data[0] < rows[j].data[0]
+	AggStats
+}
+
+// jsonEvent is one line of the NDJSON stream jsonReporter writes
+type jsonEvent struct {
+	Plots   []jsonPlot  `json:"plots"`
+	Summary jsonSummary `json:"summary"`
+}
+
+// jsonPlotState is what jsonReporter tracks per plot between ticks, so it can
+// compute progress and a smoothed speed from the bytes/state UpdatePlot reports
+type jsonPlotState struct {
+	total     int64
+	bytes     int64
+	state     string
+	dir       string
+	err       string
+	lastBytes int64
+	lastAt    time.Time
+	speed     float64
+}
+
+// jsonReporter is a Reporter that writes one NDJSON event to w per tick,
+// decoupling scripted consumers (a supervisor, a dashboard, a CI job) from the
+// progress bars and log lines the other Reporter implementations produce. It's meant to be combined
+// with one of those through NewMultiReporter, not used on its own, since it
+// never writes anything a human would want on a terminal
+type jsonReporter struct {
+	w io.Writer
+
+	mu    sync.Mutex
+	plots map[string]*jsonPlotState
+	agg   *aggTracker
+
+	start time.Time
+	stop  chan struct{}
+}
+
+// NewJSONReporter creates a Reporter that writes one NDJSON progress event to w
+// every jsonStreamInterval, for as long as it's tracking at least one plot
+func NewJSONReporter(w io.Writer) Reporter {
+	return &jsonReporter{w: w, plots: map[string]*jsonPlotState{}, agg: newAggTracker()}
+}
+
+func (r *jsonReporter) Write(b []byte) (n int, err error) {
+	return len(b), nil
+}
+
+func (r *jsonReporter) Start() {
+	r.start = time.Now()
+	r.stop = make(chan struct{})
+
+	ticker := time.NewTicker(jsonStreamInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				r.emit()
+				return
+			case <-ticker.C:
+				r.emit()
+			}
 		}
+	}()
+}
 
-		return a < b
-	})
+func (r *jsonReporter) Stop() {
+	close(r.stop)
+}
 
-	for _, r := range rows {
-		table.Rich(r.data, []tablewriter.Colors{[]int{r.colour}})
+func (r *jsonReporter) emit() {
+	r.mu.Lock()
+	if len(r.plots) == 0 {
+		r.mu.Unlock()
+		return
 	}
+	event := jsonEvent{Summary: jsonSummary{
+		ElapsedS: time.Since(r.start).Seconds(),
+		AggStats: r.agg.snapshot(),
+	}}
+	for id, ps := range r.plots {
+		var progress float64
+		if ps.total > 0 {
+			progress = float64(ps.bytes) / float64(ps.total)
+		}
 
-	printSectionTitle(r.w, "Summary")
-	fmt.Fprintf(r.w, "* Elapsed: %s\n", elapsed)
-	r.w.Newline()
+		event.Plots = append(event.Plots, jsonPlot{
+			ID:             id,
+			DownloadState:  ps.state,
+			BytesCompleted: ps.bytes,
+			BytesTotal:     ps.total,
+			Progress:       progress,
+			SpeedBps:       ps.speed,
+			DownloadDir:    ps.dir,
+			Error:          ps.err,
+		})
+		event.Summary.Plots++
+		if ps.state == "failed" {
+			event.Summary.Failed++
+		}
+	}
+	r.mu.Unlock()
 
-	fmt.Fprintf(r.w, "* Total plots: %d\n", len(plots))
-	yellow.Fprintf(r.w, "  * Pending: %d\n", pending)
-	magenta.Fprintf(r.w, "  * Expired: %d\n", expired)
-	magenta.Fprintf(r.w, "  * Cancelled: %d\n", cancelled)
-	blue.Fprintf(r.w, "  * Plotting: %d\n", plotting)
-	green.Fprintf(r.w, "  * Downloading: %d\n", downloading)
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(r.w, "%s\n", data)
+}
+
+func (r *jsonReporter) AddPlot(p *plot.Plot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.plots[p.ID]; ok {
+		return
+	}
+
+	r.plots[p.ID] = &jsonPlotState{
+		total:  p.GetDownloadSize(),
+		dir:    p.GetDownloadDirectory(),
+		state:  "preparing",
+		lastAt: time.Now(),
+	}
+	r.agg.add(p.ID, p.GetDownloadSize())
+}
+
+func (r *jsonReporter) UpdatePlot(id string, bytes int64, state string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ps, ok := r.plots[id]
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	if elapsed := now.Sub(ps.lastAt).Seconds(); elapsed > 0 {
+		ps.speed = float64(bytes-ps.lastBytes) / elapsed
+	}
+
+	ps.state = state
+	ps.err = ""
+	if state == "failed" {
+		ps.err = "download failed"
+	}
+	ps.bytes = bytes
+	ps.lastBytes = bytes
+	ps.lastAt = now
+
+	r.agg.update(id, bytes)
+}
+
+func (r *jsonReporter) RemovePlot(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.plots, id)
+	r.agg.remove(id)
+}
+
+// multiReporter fans Reporter calls out to every one of reporters, so an
+// additional sink (eg: jsonReporter) can observe the same plot events as the
+// primary, human-facing Reporter without replacing it. Only the first reporter
+// receives Write calls, since the others aren't meant to carry log text
+type multiReporter struct {
+	reporters []Reporter
+}
+
+// NewMultiReporter combines primary (which also receives Write calls, ie: log
+// output) with any number of additional reporters
+func NewMultiReporter(primary Reporter, others ...Reporter) Reporter {
+	return &multiReporter{reporters: append([]Reporter{primary}, others...)}
+}
 
-	r.w.Newline()
-	printSectionTitle(r.w, "Downloading and plotting")
-	table.Render()
+func (r *multiReporter) Write(b []byte) (n int, err error) {
+	return r.reporters[0].Write(b)
+}
 
-	r.w.Newline()
-	fmt.Fprint(r.w, "\n")
-	fmt.Fprint(r.w, "Press \"q + ENTER\" or \"Ctrl+C\" to exit. Downloads will resume if you restart.\n")
-	r.w.Flush()
+func (r *multiReporter) Start() {
+	for _, rep := range r.reporters {
+		rep.Start()
+	}
+}
+
+func (r *multiReporter) Stop() {
+	for _, rep := range r.reporters {
+		rep.Stop()
+	}
+}
+
+func (r *multiReporter) AddPlot(p *plot.Plot) {
+	for _, rep := range r.reporters {
+		rep.AddPlot(p)
+	}
+}
+
+func (r *multiReporter) UpdatePlot(id string, bytes int64, state string) {
+	for _, rep := range r.reporters {
+		rep.UpdatePlot(id, bytes, state)
+	}
+}
+
+func (r *multiReporter) RemovePlot(id string) {
+	for _, rep := range r.reporters {
+		rep.RemovePlot(id)
+	}
 }
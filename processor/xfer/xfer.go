@@ -0,0 +1,265 @@
+// Package xfer implements the transfer manager used by the processor to run
+// several plot downloads at the same time, instead of the one goroutine per
+// tick the Processor used to fire off on its own.
+package xfer
+
+import (
+	"chiafactory/plotorder/plot"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// Progress is a point-in-time snapshot of a Transfer
+type Progress struct {
+	BytesDownloaded int64
+	BytesTotal      int64
+}
+
+// Transfer is a handle to a single plot download submitted to a Manager
+type Transfer struct {
+	PlotID string
+
+	progress chan Progress
+	done     chan error
+	cancel   context.CancelFunc
+}
+
+// Progress returns the channel Transfer progress is reported on. It's never closed
+func (t *Transfer) Progress() <-chan Progress {
+	return t.progress
+}
+
+// Done returns the channel the Transfer's final error (or nil, on success) is sent to
+func (t *Transfer) Done() <-chan error {
+	return t.done
+}
+
+// Cancel stops the Transfer, whether it's still pending or already in flight
+func (t *Transfer) Cancel() {
+	t.cancel()
+}
+
+// Options configures a Manager
+type Options struct {
+	// MaxDownloads is the maximum number of plots downloaded at the same time,
+	// across every download directory. Zero means unlimited
+	MaxDownloads int
+
+	// MaxPerDirectory caps how many of those downloads can write to the same
+	// download directory at once, so a single disk isn't thrashed by too many
+	// parallel writes. Zero means unlimited
+	MaxPerDirectory int
+}
+
+type job struct {
+	p   *plot.Plot
+	dir string
+	t   *Transfer
+	ctx context.Context
+}
+
+// Manager schedules plot downloads onto a bounded pool of workers. It deduplicates
+// in-flight plots by ID, prioritises resumed downloads over fresh ones and, among
+// the rest, the largest remaining download first, and retries a failed download on
+// a jittered exponential backoff schedule
+type Manager struct {
+	ctx  context.Context
+	opts Options
+
+	mu        sync.Mutex
+	pending   []*job
+	inFlight  map[string]bool
+	active    int
+	activeDir map[string]int
+
+	wg   sync.WaitGroup
+	wake chan struct{}
+}
+
+// NewManager creates a Manager bound to ctx. Transfers still running when ctx is
+// cancelled are cancelled along with it
+func NewManager(ctx context.Context, opts Options) *Manager {
+	m := &Manager{
+		ctx:       ctx,
+		opts:      opts,
+		inFlight:  map[string]bool{},
+		activeDir: map[string]int{},
+		wake:      make(chan struct{}, 1),
+	}
+	go m.dispatchLoop()
+	return m
+}
+
+// Submit schedules p's download. It returns nil if p is already being downloaded
+// (plots are deduplicated by ID), so callers can safely call Submit on every tick
+// without tracking what's already in flight themselves
+func (m *Manager) Submit(p *plot.Plot) *Transfer {
+	m.mu.Lock()
+	if m.inFlight[p.ID] {
+		m.mu.Unlock()
+		return nil
+	}
+	m.inFlight[p.ID] = true
+
+	jobCtx, cancel := context.WithCancel(m.ctx)
+	t := &Transfer{
+		PlotID:   p.ID,
+		progress: make(chan Progress, 1),
+		done:     make(chan error, 1),
+		cancel:   cancel,
+	}
+	m.wg.Add(1)
+	m.pending = append(m.pending, &job{p: p, dir: p.GetDownloadDirectory(), t: t, ctx: jobCtx})
+	m.mu.Unlock()
+
+	m.poke()
+	return t
+}
+
+// Wait blocks until every submitted Transfer has finished
+func (m *Manager) Wait() {
+	m.wg.Wait()
+}
+
+// Active returns the number of transfers currently running (not merely pending)
+func (m *Manager) Active() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.active
+}
+
+func (m *Manager) poke() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Manager) dispatchLoop() {
+	for {
+		select {
+		case <-m.ctx.Done():
+			// jobs still pending will never be dispatched, so finish them here
+			// or Wait would block forever
+			m.mu.Lock()
+			for _, j := range m.pending {
+				delete(m.inFlight, j.p.ID)
+				j.t.done <- m.ctx.Err()
+				m.wg.Done()
+			}
+			m.pending = nil
+			m.mu.Unlock()
+			return
+		case <-m.wake:
+			m.dispatch()
+		}
+	}
+}
+
+// dispatch starts as many pending jobs as there's room for. Jobs already resuming a
+// partial download go first; among the rest, the one with the most bytes left to
+// download goes first, so a handful of small plots don't hold a slot a bigger
+// plot could have made better use of
+func (m *Manager) dispatch() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sort.SliceStable(m.pending, func(i, j int) bool {
+		a, b := m.pending[i].p, m.pending[j].p
+		aResuming := a.GetDownloadedBytes() > 0
+		bResuming := b.GetDownloadedBytes() > 0
+		if aResuming != bResuming {
+			return aResuming
+		}
+		return a.GetRemainingBytes() > b.GetRemainingBytes()
+	})
+
+	remaining := m.pending[:0:0]
+	for _, j := range m.pending {
+		if m.opts.MaxDownloads > 0 && m.active >= m.opts.MaxDownloads {
+			remaining = append(remaining, j)
+			continue
+		}
+		if m.opts.MaxPerDirectory > 0 && m.activeDir[j.dir] >= m.opts.MaxPerDirectory {
+			remaining = append(remaining, j)
+			continue
+		}
+
+		m.active++
+		m.activeDir[j.dir]++
+		go m.run(j)
+	}
+	m.pending = remaining
+}
+
+// run downloads a single plot, retrying on a jittered exponential backoff schedule
+// until it succeeds or the Transfer is cancelled
+func (m *Manager) run(j *job) {
+	defer func() {
+		m.mu.Lock()
+		m.active--
+		m.activeDir[j.dir]--
+		delete(m.inFlight, j.p.ID)
+		m.mu.Unlock()
+
+		m.wg.Done()
+		m.poke()
+	}()
+
+	exp := backoff.NewExponentialBackOff()
+	exp.InitialInterval = 1 * time.Second
+	exp.MaxInterval = 5 * time.Minute
+	exp.MaxElapsedTime = 0 // keep retrying until the transfer is cancelled
+
+	err := backoff.Retry(func() error {
+		select {
+		case <-j.ctx.Done():
+			return backoff.Permanent(j.ctx.Err())
+		default:
+		}
+
+		reportProgress := func() {
+			select {
+			case j.t.progress <- Progress{BytesDownloaded: j.p.GetDownloadedBytes(), BytesTotal: j.p.GetDownloadSize()}:
+			default:
+			}
+		}
+
+		// report j.p's downloaded bytes on a tick while Download is in flight,
+		// instead of only once it returns, so j.t.Progress() reflects the
+		// transfer as it happens rather than only its final outcome
+		stopTicking := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(1 * time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stopTicking:
+					return
+				case <-ticker.C:
+					reportProgress()
+				}
+			}
+		}()
+
+		err := j.p.Download(j.ctx)
+		close(stopTicking)
+		wg.Wait()
+		reportProgress()
+
+		if err != nil {
+			log.Warnf("%s transfer failed, will retry (%s)", j.p, err.Error())
+		}
+		return err
+	}, backoff.WithContext(exp, j.ctx))
+
+	j.t.done <- err
+}
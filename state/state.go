@@ -0,0 +1,181 @@
+// Package state persists a Processor's in-progress scheduling and retry
+// information to disk, so restarting plotorder doesn't have to reprobe every
+// plot in an order from scratch
+package state
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// version is bumped whenever the Snapshot format changes in a way that's not
+// backwards compatible. Load refuses a file written with a different version,
+// the same way it refuses one it can't otherwise make sense of
+const version = 1
+
+// PlotState is the persisted state for a single plot
+type PlotState struct {
+	// NextCheckAt is when we're next due to ask the API about this plot. Restoring
+	// it means we don't have to immediately re-check every plot in the order on
+	// startup
+	NextCheckAt time.Time
+
+	// DownloadDirectory is the plotDir this plot's download was last known to be
+	// using
+	DownloadDirectory string
+
+	// DownloadedBytes is how much of the file had been downloaded as of the last
+	// save. It's only used to sanity-check DownloadDirectory against what's
+	// actually on disk when loading; the downloaded file itself always remains the
+	// source of truth for how much has been downloaded
+	DownloadedBytes int64
+
+	// Retries counts how many times this plot's download has failed and been
+	// retried
+	Retries int
+
+	// ReservedBytes is how many bytes of disk.Manager's reservation ledger were
+	// set aside for this plot as of the last save. It's advisory only: on
+	// restart, every plot goes back through getPlotDownloadDirectory, which
+	// re-derives and re-reserves its directory from scratch, so this value is
+	// never replayed back into a live disk.Manager (doing so would double-count
+	// it against that fresh reservation)
+	ReservedBytes int64
+}
+
+// Snapshot is everything a Processor needs to resume without reprobing every plot
+type Snapshot struct {
+	Version int
+	Plots   map[string]PlotState
+}
+
+// NewSnapshot creates an empty, correctly versioned Snapshot for a caller (eg: a
+// Processor) to fill in before it's passed to Store.Save
+func NewSnapshot() *Snapshot {
+	return &Snapshot{Version: version, Plots: map[string]PlotState{}}
+}
+
+// Store loads and saves Snapshots to a file, debouncing writes so a busy
+// Processor doesn't turn every byte of progress into a disk write
+type Store struct {
+	path string
+
+	mu       sync.Mutex
+	snapshot *Snapshot
+}
+
+// NewStore creates a Store backed by the file at path. The file isn't read or
+// created until Load or Save is called
+func NewStore(path string) *Store {
+	return &Store{path: path, snapshot: NewSnapshot()}
+}
+
+// Load reads the Snapshot previously saved at s.path. A missing file is not an
+// error: it just yields an empty Snapshot, as does any file this version of
+// plotorder can't make sense of (wrong version, truncated write, etc), since the
+// cache is just an optimisation and losing it should never stop plotorder from
+// working
+func (s *Store) Load() *Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("[state] could not read %s, starting fresh (%s)", s.path, err)
+		}
+		return s.snapshot
+	}
+
+	var snap Snapshot
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&snap); err != nil {
+		log.Warnf("[state] %s is not a valid state file, starting fresh (%s)", s.path, err)
+		return s.snapshot
+	}
+
+	if snap.Version != version {
+		log.Warnf("[state] %s was written by an incompatible version (%d, expected %d), starting fresh", s.path, snap.Version, version)
+		return s.snapshot
+	}
+
+	if snap.Plots == nil {
+		snap.Plots = map[string]PlotState{}
+	}
+
+	s.snapshot = &snap
+	return s.snapshot
+}
+
+// Save atomically writes snap to s.path, so a crash or power loss mid-write
+// never leaves a corrupt or half-written state file behind
+func (s *Store) Save(snap *Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.snapshot = snap
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(snap); err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(s.path)
+	tmp, err := ioutil.TempFile(dir, ".plotorder.state.*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Reset removes the state file, so the next Load starts from an empty Snapshot
+func (s *Store) Reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.snapshot = NewSnapshot()
+
+	err := os.Remove(s.path)
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Run periodically calls snapshot and saves its result, every interval, until
+// stop is closed, at which point it saves one last time before returning. It's
+// meant to be run in its own goroutine
+func (s *Store) Run(stop <-chan struct{}, interval time.Duration, snapshot func() *Snapshot) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			if err := s.Save(snapshot()); err != nil {
+				log.Warnf("[state] could not save final state to %s (%s)", s.path, err)
+			}
+			return
+		case <-ticker.C:
+			if err := s.Save(snapshot()); err != nil {
+				log.Warnf("[state] could not save state to %s (%s)", s.path, err)
+			}
+		}
+	}
+}